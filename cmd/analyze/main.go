@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/comfortablynumb/victor/internal/analyze"
+	"github.com/comfortablynumb/victor/internal/util"
+)
+
+const (
+	// ParamConfigPath provides file with configuration.
+	ParamConfigPath = "config-path"
+	// ParamBackend is the backend whose rate limit is analyzed.
+	ParamBackend = "backend"
+	// ParamPort is the destination port of the statsd datagrams of a pcap capture.
+	ParamPort = "port"
+	// ParamTop caps the metric names reported.
+	ParamTop = "top"
+	// ParamTagKeys caps the tag keys reported by metric name.
+	ParamTagKeys = "tag-keys"
+	// ParamJSON makes the report be written in JSON format.
+	ParamJSON = "json"
+	// ParamVerbose enables verbose logging.
+	ParamVerbose = "verbose"
+)
+
+func main() {
+	cmd := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	cmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s --config-path <config> [flags] [file of statsd lines or pcap capture, stdin by default]\n", os.Args[0])
+		cmd.PrintDefaults()
+	}
+
+	configPath := cmd.String(ParamConfigPath, "", "Path to the configuration file")
+	backendName := cmd.String(ParamBackend, "", "Backend whose rate limit is analyzed. By default, the shared one if enabled, or the first rate limited one")
+	port := cmd.Int(ParamPort, 8125, "Destination port of the statsd datagrams of a pcap capture. 0 reads every UDP datagram")
+	top := cmd.Int(ParamTop, 20, "Maximum number of metric names reported. 0 reports all of them")
+	tagKeys := cmd.Int(ParamTagKeys, 5, "Maximum number of tag keys reported by metric name")
+	jsonOutput := cmd.Bool(ParamJSON, false, "Write the report in JSON format")
+	verbose := cmd.Bool(ParamVerbose, false, "Verbose")
+
+	if err := cmd.Parse(os.Args[1:]); err != nil {
+		if err == pflag.ErrHelp {
+			return
+		}
+
+		logrus.Fatalf("Error while parsing arguments: %v", err)
+	}
+
+	// The rate limited backend logs its settings when it's created, which is noise here
+
+	logrus.SetLevel(logrus.WarnLevel)
+
+	if *verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if *configPath == "" || cmd.NArg() > 1 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+
+	v := viper.New()
+
+	util.InitViper(v, "")
+
+	v.SetConfigFile(*configPath)
+
+	if err := v.ReadInConfig(); err != nil {
+		logrus.Fatalf("Error while reading configuration: %v", err)
+	}
+
+	var input io.Reader = os.Stdin
+
+	if path := cmd.Arg(0); path != "" && path != "-" {
+		file, err := os.Open(path)
+
+		if err != nil {
+			logrus.Fatalf("Error while opening the input: %v", err)
+		}
+
+		defer file.Close()
+
+		input = file
+	}
+
+	ctx, cancelFunc := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelFunc()
+
+	report, err := analyze.Analyze(ctx, v, *backendName, *port, input)
+
+	if err != nil {
+		logrus.Fatalf("Error while analyzing: %v", err)
+	}
+
+	if *top > 0 && len(report.Metrics) > *top {
+		report.Metrics = report.Metrics[:*top]
+	}
+
+	for i := range report.Metrics {
+		metric := &report.Metrics[i]
+
+		metric.TagKeys = metric.TagKeys[:min(max(*tagKeys, 0), len(metric.TagKeys))]
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(report); err != nil {
+			logrus.Fatalf("Error while writing the report: %v", err)
+		}
+
+		return
+	}
+
+	writeReport(os.Stdout, report)
+}
+
+func writeReport(out io.Writer, report *analyze.Report) {
+	droppedPercent := 0.0
+
+	if report.Series > 0 {
+		droppedPercent = 100 * float64(report.DroppedSeries) / float64(report.Series)
+	}
+
+	fmt.Fprintf(out, "Backend %s: %d datagrams, %d flushes, %d windows\n", report.Backend, report.Datagrams, report.Flushes, report.Windows)
+	fmt.Fprintf(out, "Series: %d, dropped: %d (%.1f%%)\n\n", report.Series, report.DroppedSeries, droppedPercent)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "METRIC NAME\tSERIES\tLIMIT\tDROPPED\tTAG KEYS (VALUES)")
+
+	for _, metric := range report.Metrics {
+		tagKeys := make([]string, 0, len(metric.TagKeys))
+
+		for _, tagKey := range metric.TagKeys {
+			tagKeys = append(tagKeys, fmt.Sprintf("%s=%d", tagKey.TagKey, tagKey.Values))
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", metric.MetricName, metric.Series, metric.Limit, metric.DroppedSeries, strings.Join(tagKeys, " "))
+	}
+
+	w.Flush()
+}
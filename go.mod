@@ -6,8 +6,9 @@ toolchain go1.23.5
 
 require (
 	github.com/atlassian/gostatsd v0.0.0-20241111234124-b0852c13bda3
-	github.com/axiomhq/hyperloglog v0.2.3
 	github.com/cactus/go-statsd-client/v5 v5.1.0
+	github.com/dgryski/go-metro v0.0.0-20180109044635-280f6062b5bc
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/sirupsen/logrus v1.9.0
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.17.0
@@ -36,9 +37,7 @@ require (
 	github.com/aws/smithy-go v1.22.0 // indirect
 	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
-	github.com/dgryski/go-metro v0.0.0-20180109044635-280f6062b5bc // indirect
 	github.com/emicklei/go-restful/v3 v3.8.0 // indirect
-	github.com/fsnotify/fsnotify v1.6.0 // indirect
 	github.com/go-logr/logr v1.2.3 // indirect
 	github.com/go-openapi/jsonpointer v0.19.5 // indirect
 	github.com/go-openapi/jsonreference v0.19.5 // indirect
@@ -0,0 +1,218 @@
+package admin
+
+import (
+	"bufio"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/comfortablynumb/victor/internal/backend"
+)
+
+// Constants
+
+const (
+	// DefaultMaxMetricNames is the default maximum number of metric names exported by backend on /metrics.
+	DefaultMaxMetricNames = 100
+	metricsPrefix         = "victor_rate_limit_"
+	metricsContentType    = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Structs
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// metricFamily is a gauge or a counter of the Prometheus text format, with all its samples, so they are written
+// together.
+type metricFamily struct {
+	name       string
+	help       string
+	metricType string
+	samples    []sample
+}
+
+// add adds a sample with the given label names and values, in pairs.
+func (f *metricFamily) add(value float64, labels ...string) {
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+// metricFamilies keeps the families in the order they are created, so the output is stable.
+type metricFamilies struct {
+	families []*metricFamily
+}
+
+func (m *metricFamilies) gauge(name string, help string) *metricFamily {
+	return m.add(name, help, "gauge")
+}
+
+func (m *metricFamilies) counter(name string, help string) *metricFamily {
+	return m.add(name, help, "counter")
+}
+
+func (m *metricFamilies) add(name string, help string, metricType string) *metricFamily {
+	f := &metricFamily{name: metricsPrefix + name, help: help, metricType: metricType}
+
+	m.families = append(m.families, f)
+
+	return f
+}
+
+func (m *metricFamilies) write(w *bufio.Writer) {
+	for _, f := range m.families {
+		if len(f.samples) == 0 {
+			continue
+		}
+
+		w.WriteString("# HELP " + f.name + " " + f.help + "\n")
+		w.WriteString("# TYPE " + f.name + " " + f.metricType + "\n")
+
+		for _, s := range f.samples {
+			w.WriteString(f.name)
+
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				if i == 0 {
+					w.WriteString("{")
+				} else {
+					w.WriteString(",")
+				}
+
+				w.WriteString(s.labels[i] + `="` + escapeLabelValue(s.labels[i+1]) + `"`)
+			}
+
+			if len(s.labels) > 1 {
+				w.WriteString("}")
+			}
+
+			w.WriteString(" " + strconv.FormatFloat(s.value, 'g', -1, 64) + "\n")
+		}
+	}
+}
+
+// handleMetrics exposes the state of the rate limited backends in the Prometheus text format. Only the tenants, metric
+// names and tag keys with the highest estimates are exported, up to maxMetricNames of each by backend, so the labels
+// don't grow with the cardinality Victor is there to limit.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := &metricFamilies{}
+
+	windowAge := m.gauge("window_age_seconds", "Seconds since the start of the current window.")
+	memory := m.gauge("memory_bytes", "Approximate memory used by the HyperLogLogs of the backend.")
+	metricNames := m.gauge("metric_names", "Number of tracked metric names.")
+	omitted := m.gauge("metric_names_omitted", "Number of tracked tenants, metric names and tag keys not exported, over the maximum.")
+	totalCardinality := m.gauge("total_cardinality", "Estimated number of series of all the metric names together.")
+	totalLimit := m.gauge("total_limit", "Limit of series of all the metric names together.")
+	cardinality := m.gauge("cardinality", "Estimated number of series of the metric name in the current window.")
+	limit := m.gauge("limit", "Limit of series of the metric name.")
+	droppedValues := m.counter("dropped_values_total", "Values of the series dropped since the backend started, one by counter or gauge and one by value of a timer or set.")
+	dropped := m.gauge("dropped_series", "Times a new series of the metric name was rejected in the current window, counting a series again on every flush it's rejected in.")
+	metricMemory := m.gauge("metric_memory_bytes", "Approximate memory used by the HyperLogLogs of the metric name.")
+	tagValues := m.gauge("tag_values", "Estimated number of values of the tag key in the current window.")
+	tagValuesLimit := m.gauge("tag_values_limit", "Limit of values of the tag key.")
+	tagValuesDropped := m.gauge("tag_values_dropped", "Times a new value of the tag key was rewritten or stripped in the current window, counting a value again on every flush it's rewritten in.")
+
+	now := time.Now()
+
+	for _, name := range slices.Sorted(maps.Keys(s.backends)) {
+		state := s.backends[name].State()
+
+		windowAge.add(now.Sub(state.WindowStart).Seconds(), "backend", name)
+		memory.add(float64(state.MemoryBytes), "backend", name)
+		metricNames.add(float64(len(state.Metrics)), "backend", name)
+
+		for _, metricType := range slices.Sorted(maps.Keys(state.DroppedValues)) {
+			droppedValues.add(float64(state.DroppedValues[metricType]), "backend", name, "metric_type", metricType)
+		}
+
+		if state.Total != nil {
+			totalCardinality.add(float64(state.Total.Estimate), "backend", name)
+			totalLimit.add(float64(state.Total.Limit), "backend", name)
+		}
+
+		tenants := topN(state.Tenants, s.maxMetricNames, func(tenant backend.TotalState) uint64 {
+			return tenant.Estimate
+		})
+
+		for _, tenant := range tenants {
+			totalCardinality.add(float64(tenant.Estimate), "backend", name, ParamTenant, tenant.Tenant)
+
+			if tenant.Limit > 0 {
+				totalLimit.add(float64(tenant.Limit), "backend", name, ParamTenant, tenant.Tenant)
+			}
+		}
+
+		metrics := topN(state.Metrics, s.maxMetricNames, func(metric backend.MetricState) uint64 {
+			return metric.Estimate
+		})
+
+		for _, metric := range metrics {
+			labels := []string{"backend", name, "metric_name", metric.MetricName}
+
+			if metric.Tenant != "" {
+				labels = append(labels, ParamTenant, metric.Tenant)
+			}
+
+			cardinality.add(float64(metric.Estimate), labels...)
+			limit.add(float64(metric.Limit), labels...)
+			dropped.add(float64(metric.Dropped), labels...)
+			metricMemory.add(float64(metric.MemoryBytes), labels...)
+		}
+
+		tagKeys := topN(state.TagValues, s.maxMetricNames, func(tagKey backend.TagValuesState) uint64 {
+			return tagKey.Estimate
+		})
+
+		for _, tagKey := range tagKeys {
+			labels := []string{"backend", name, "tag_key", tagKey.TagKey}
+
+			if tagKey.MetricName != "" {
+				labels = append(labels, "metric_name", tagKey.MetricName)
+			}
+
+			tagValues.add(float64(tagKey.Estimate), labels...)
+			tagValuesLimit.add(float64(tagKey.Limit), labels...)
+			tagValuesDropped.add(float64(tagKey.Dropped), labels...)
+		}
+
+		omitted.add(float64(len(state.Tenants)-len(tenants)+len(state.Metrics)-len(metrics)+len(state.TagValues)-len(tagKeys)), "backend", name)
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+
+	m.write(bw)
+
+	if err := bw.Flush(); err != nil {
+		s.logger.WithError(err).Error("Failed to write the metrics")
+	}
+}
+
+// Static functions
+
+// topN returns the n items with the highest values, or all of them if there are no more than n.
+func topN[T any](items []T, n int, value func(T) uint64) []T {
+	if len(items) <= n {
+		return items
+	}
+
+	items = slices.Clone(items)
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return value(items[i]) > value(items[j])
+	})
+
+	return items[:n]
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,183 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/comfortablynumb/victor/internal/backend"
+	"github.com/sirupsen/logrus"
+)
+
+// Constants
+
+const (
+	ParamMetric     = "metric"
+	ParamTenant     = "tenant"
+	shutdownTimeout = 5 * time.Second
+)
+
+// Structs
+
+// Server exposes an HTTP API to inspect and reset the cardinality state of the rate limited backends, and to scrape it
+// with Prometheus.
+type Server struct {
+	addr           string
+	backends       map[string]*backend.RateLimitedBackend
+	maxMetricNames int
+	server         *http.Server
+	logger         logrus.FieldLogger
+}
+
+func (s *Server) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := s.server.Shutdown(shutdownCtx); err != nil {
+			s.logger.WithError(err).Error("Failed to shut down the admin server")
+		}
+	}()
+
+	s.logger.WithField("address", s.addr).Info("Admin server started")
+
+	if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.WithError(err).Error("Admin server failed")
+	}
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	states := make([]backend.BackendState, 0, len(s.backends))
+
+	for _, b := range s.backends {
+		states = append(states, b.State())
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Backend < states[j].Backend
+	})
+
+	writeJSON(w, http.StatusOK, states)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.backend(w, r)
+
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, b.State())
+}
+
+func (s *Server) handleTop(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.backend(w, r)
+
+	if !ok {
+		return
+	}
+
+	offenders, enabled := b.TopOffenders()
+
+	if !enabled {
+		writeError(w, http.StatusNotFound, "top offenders are not enabled")
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, offenders)
+}
+
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.backend(w, r)
+
+	if !ok {
+		return
+	}
+
+	metricName := r.URL.Query().Get(ParamMetric)
+
+	if metricName == "" {
+		b.Reset()
+
+		s.logger.WithField("backend", b.Name()).Info("Rate limit state reset through the admin API")
+
+		writeJSON(w, http.StatusOK, map[string]string{"backend": b.Name()})
+
+		return
+	}
+
+	tenant := r.URL.Query().Get(ParamTenant)
+
+	if !b.ResetMetric(tenant, metricName) {
+		writeError(w, http.StatusNotFound, "metric is not tracked")
+
+		return
+	}
+
+	s.logger.WithField("backend", b.Name()).
+		WithField(ParamTenant, tenant).
+		WithField(ParamMetric, metricName).
+		Info("Rate limit state of metric reset through the admin API")
+
+	writeJSON(w, http.StatusOK, map[string]string{"backend": b.Name(), ParamTenant: tenant, ParamMetric: metricName})
+}
+
+func (s *Server) backend(w http.ResponseWriter, r *http.Request) (*backend.RateLimitedBackend, bool) {
+	b, ok := s.backends[r.PathValue("backend")]
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "backend is not rate limited")
+	}
+
+	return b, ok
+}
+
+// Static functions
+
+func NewServer(addr string, backends []*backend.RateLimitedBackend, maxMetricNames int, logger logrus.FieldLogger) *Server {
+	s := &Server{
+		addr:           addr,
+		backends:       make(map[string]*backend.RateLimitedBackend, len(backends)),
+		maxMetricNames: max(maxMetricNames, 0),
+		logger:         logger,
+	}
+
+	for _, b := range backends {
+		s.backends[b.Name()] = b
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /rate-limit", s.handleList)
+	mux.HandleFunc("GET /rate-limit/{backend}", s.handleGet)
+	mux.HandleFunc("GET /rate-limit/{backend}/top", s.handleTop)
+	mux.HandleFunc("POST /rate-limit/{backend}/reset", s.handleReset)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: shutdownTimeout,
+	}
+
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logrus.WithError(err).Error("Failed to write admin API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
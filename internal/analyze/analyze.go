@@ -0,0 +1,496 @@
+package analyze
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+	"github.com/comfortablynumb/victor/internal/backend"
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/comfortablynumb/victor/internal/util"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Constants
+
+const (
+	// linesPerFlush is how many lines of a file of raw statsd lines are sent per flush, as they have no timestamps.
+	linesPerFlush = 10000
+	// datagramsPerBatch is how many datagrams are sent to the parser at once.
+	datagramsPerBatch = 1000
+	maxLineLength     = 64 * 1024
+	tagKeyValueSplit  = ":"
+	tagsKeySeparator  = ","
+)
+
+// Structs
+
+type TagKeyReport struct {
+	TagKey string `json:"tag_key"`
+	Values int    `json:"values"`
+}
+
+// MetricReport is a metric name of the input with its distinct series, how many of them the rate limit drops at least
+// once, and its tag keys with their distinct values.
+type MetricReport struct {
+	MetricName    string         `json:"metric_name"`
+	Series        int            `json:"series"`
+	Limit         uint64         `json:"limit"`
+	DroppedSeries int            `json:"dropped_series"`
+	TagKeys       []TagKeyReport `json:"tag_keys"`
+}
+
+// Report is the result of replaying the input through the rate limit of a backend, with the metric names with the
+// most series first.
+type Report struct {
+	Backend       string         `json:"backend"`
+	Datagrams     int            `json:"datagrams"`
+	Flushes       int            `json:"flushes"`
+	Windows       int            `json:"windows"`
+	Series        int            `json:"series"`
+	DroppedSeries int            `json:"dropped_series"`
+	Metrics       []MetricReport `json:"metrics"`
+}
+
+type metricStats struct {
+	// series tells, by tags key, whether the series has been dropped
+	series    map[string]bool
+	tagValues map[string]map[string]struct{}
+	limit     uint64
+}
+
+func (s *metricStats) add(tagsKey string, dropped bool) {
+	previous, ok := s.series[tagsKey]
+
+	s.series[tagsKey] = previous || dropped
+
+	if ok {
+		return
+	}
+
+	for _, tag := range strings.Split(tagsKey, tagsKeySeparator) {
+		if tag == "" {
+			continue
+		}
+
+		tagKey, tagValue, _ := strings.Cut(tag, tagKeyValueSplit)
+		values, ok := s.tagValues[tagKey]
+
+		if !ok {
+			values = make(map[string]struct{})
+			s.tagValues[tagKey] = values
+		}
+
+		values[tagValue] = struct{}{}
+	}
+}
+
+// recorder keeps the metric map the rate limited backend sends on each flush.
+type recorder struct {
+	name      string
+	metricMap *gostatsd.MetricMap
+}
+
+func (r *recorder) Name() string {
+	return r.name
+}
+
+func (r *recorder) SendMetricsAsync(_ context.Context, metricMap *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	r.metricMap = metricMap
+
+	callback(nil)
+}
+
+func (r *recorder) SendEvent(_ context.Context, _ *gostatsd.Event) error {
+	return nil
+}
+
+// analyzer replays the datagrams of the input through the statsd parser, aggregating them in flushes, and sends every
+// flush through the rate limited backend, as the server does. The windows of the backend end by the time of the
+// datagrams, instead of the wall clock. The series missing from what the backend sends, once the ones whose tags were
+// rewritten by the tag value limits are looked up by their new tags, are the dropped ones.
+type analyzer struct {
+	name          string
+	backend       *backend.RateLimitedBackend
+	recorder      *recorder
+	namespace     string
+	ignoreHost    bool
+	flushInterval time.Duration
+	port          int
+
+	in         chan []*statsd.Datagram
+	batch      []*statsd.Datagram
+	pending    *gostatsd.MetricMap
+	metrics    map[string]*metricStats
+	rewrites   map[string]map[string]string
+	flushStart time.Time
+	datagrams  int
+	flushes    int
+	windows    int
+}
+
+func (a *analyzer) EstimatedTags() int {
+	return 0
+}
+
+// DispatchMetricMap is called by the parser, which is done with a batch when it receives the next one.
+func (a *analyzer) DispatchMetricMap(_ context.Context, metricMap *gostatsd.MetricMap) {
+	a.pending.Merge(metricMap)
+}
+
+func (a *analyzer) DispatchEvent(_ context.Context, _ *gostatsd.Event) {
+}
+
+func (a *analyzer) WaitForEvents() {
+}
+
+func (a *analyzer) run(ctx context.Context, r io.Reader) (*Report, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	parser := statsd.NewDatagramParser(a.in, a.namespace, a.ignoreHost, 0, a, 0, false, logrus.StandardLogger())
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		parser.Run(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	br := bufio.NewReaderSize(r, maxLineLength)
+	magic, _ := br.Peek(4)
+
+	var err error
+
+	if isPcap(magic) {
+		err = a.readPcap(ctx, br)
+	} else {
+		err = a.readLines(ctx, br)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	return a.report(), nil
+}
+
+func (a *analyzer) readLines(ctx context.Context, r *bufio.Reader) error {
+	scanner := bufio.NewScanner(r)
+
+	scanner.Buffer(make([]byte, 0, maxLineLength), maxLineLength)
+
+	lines := 0
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if err := a.add(ctx, gostatsd.UnknownSource, 0, bytes.Clone(line)); err != nil {
+			return err
+		}
+
+		lines++
+
+		if lines%linesPerFlush == 0 {
+			if err := a.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read the statsd lines: %w", err)
+	}
+
+	return nil
+}
+
+func (a *analyzer) readPcap(ctx context.Context, r *bufio.Reader) error {
+	pcap, err := newPcapReader(r, a.port)
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		p, err := pcap.next()
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read the pcap capture: %w", err)
+		}
+
+		if a.flushStart.IsZero() {
+			a.flushStart = p.timestamp
+
+			a.backend.ResetAt(p.timestamp)
+		}
+
+		if flushTime := a.flushStart.Add(a.flushInterval); !p.timestamp.Before(flushTime) {
+			if a.backend.EndWindows(flushTime) {
+				a.windows++
+			}
+
+			if err := a.flush(ctx); err != nil {
+				return err
+			}
+
+			a.flushStart = p.timestamp
+		}
+
+		if err := a.add(ctx, gostatsd.Source(p.source), gostatsd.Nanotime(p.timestamp.UnixNano()), p.payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *analyzer) add(ctx context.Context, source gostatsd.Source, timestamp gostatsd.Nanotime, msg []byte) error {
+	a.datagrams++
+	a.batch = append(a.batch, &statsd.Datagram{IP: source, Msg: msg, Timestamp: timestamp, DoneFunc: func() {}})
+
+	if len(a.batch) < datagramsPerBatch {
+		return nil
+	}
+
+	return a.send(ctx, a.batch)
+}
+
+func (a *analyzer) send(ctx context.Context, batch []*statsd.Datagram) error {
+	a.batch = nil
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case a.in <- batch:
+		return nil
+	}
+}
+
+// flush waits for the parser to be done with the pending datagrams, and sends their metrics through the backend.
+func (a *analyzer) flush(ctx context.Context) error {
+	if len(a.batch) > 0 {
+		if err := a.send(ctx, a.batch); err != nil {
+			return err
+		}
+	}
+
+	if err := a.send(ctx, nil); err != nil {
+		return err
+	}
+
+	offered := a.pending
+
+	if offered.IsEmpty() {
+		return nil
+	}
+
+	a.pending = gostatsd.NewMetricMap(false)
+	a.rewrites = make(map[string]map[string]string)
+	a.flushes++
+
+	a.backend.SendMetricsAsync(ctx, offered, func([]error) {})
+
+	admitted := a.recorder.metricMap
+
+	recordSeries(a, offered.Counters, admitted.Counters)
+	recordSeries(a, offered.Gauges, admitted.Gauges)
+	recordSeries(a, offered.Timers, admitted.Timers)
+	recordSeries(a, offered.Sets, admitted.Sets)
+
+	// The tracked metric names may be forgotten when the window ends, so their limits are kept after every flush
+
+	for _, metric := range a.backend.State().Metrics {
+		if stats, ok := a.metrics[metric.MetricName]; ok {
+			stats.limit = metric.Limit
+		}
+	}
+
+	return nil
+}
+
+func (a *analyzer) rewritten(metricName string, tagsKey string, newTagsKey string) {
+	rewrites, ok := a.rewrites[metricName]
+
+	if !ok {
+		rewrites = make(map[string]string)
+		a.rewrites[metricName] = rewrites
+	}
+
+	rewrites[tagsKey] = newTagsKey
+}
+
+func (a *analyzer) report() *Report {
+	report := &Report{
+		Backend:   a.name,
+		Datagrams: a.datagrams,
+		Flushes:   a.flushes,
+		Windows:   a.windows + 1,
+		Metrics:   make([]MetricReport, 0, len(a.metrics)),
+	}
+
+	for metricName, stats := range a.metrics {
+		metric := MetricReport{
+			MetricName: metricName,
+			Series:     len(stats.series),
+			Limit:      stats.limit,
+			TagKeys:    make([]TagKeyReport, 0, len(stats.tagValues)),
+		}
+
+		for _, dropped := range stats.series {
+			if dropped {
+				metric.DroppedSeries++
+			}
+		}
+
+		for tagKey, values := range stats.tagValues {
+			metric.TagKeys = append(metric.TagKeys, TagKeyReport{TagKey: tagKey, Values: len(values)})
+		}
+
+		slices.SortFunc(metric.TagKeys, func(a, b TagKeyReport) int {
+			return cmp.Or(cmp.Compare(b.Values, a.Values), cmp.Compare(a.TagKey, b.TagKey))
+		})
+
+		report.Series += metric.Series
+		report.DroppedSeries += metric.DroppedSeries
+		report.Metrics = append(report.Metrics, metric)
+	}
+
+	slices.SortFunc(report.Metrics, func(a, b MetricReport) int {
+		return cmp.Or(cmp.Compare(b.Series, a.Series), cmp.Compare(a.MetricName, b.MetricName))
+	})
+
+	return report
+}
+
+// Static functions
+
+// Analyze replays a file of raw statsd lines, or a pcap capture of the UDP datagrams sent to the given port, through
+// the rate limit of the given backend of the configuration, or of the shared one if the name is empty and it's
+// enabled, or of the first rate limited backend otherwise. The rate limit always runs in drop mode, and its state is
+// never persisted.
+func Analyze(ctx context.Context, v *viper.Viper, backendName string, port int, r io.Reader) (*Report, error) {
+	if backendName == "" {
+		backendName = defaultBackendName(v)
+
+		if backendName == "" {
+			return nil, errors.New("no backend has the rate limit enabled")
+		}
+	}
+
+	backendViper := util.GetSubViper(v, backendName)
+
+	if !util.GetSubViper(backendViper, config.ParamRateLimit).GetBool(config.ParamEnabled) {
+		return nil, fmt.Errorf("the rate limit is not enabled for the backend. Value: %s", backendName)
+	}
+
+	// The rate limit settings are copied as they are, so the metric names with dots in the limits stay untouched
+
+	rateLimit := make(map[string]any)
+
+	if settings, ok := backendViper.Get(config.ParamRateLimit).(map[string]any); ok {
+		maps.Copy(rateLimit, settings)
+	}
+
+	rateLimit[config.ParamEnabled] = true
+	rateLimit[config.ParamMode] = config.ModeDrop
+
+	delete(rateLimit, config.ParamStateFile)
+
+	rateLimitViper := viper.New()
+
+	rateLimitViper.Set(config.ParamRateLimit, rateLimit)
+	v.SetDefault(gostatsd.ParamFlushInterval, gostatsd.DefaultFlushInterval)
+
+	rec := &recorder{name: backendName}
+	a := &analyzer{
+		name:          backendName,
+		backend:       backend.NewRateLimitedBackend(rec, rateLimitViper),
+		recorder:      rec,
+		namespace:     v.GetString(gostatsd.ParamNamespace),
+		ignoreHost:    v.GetBool(gostatsd.ParamIgnoreHost),
+		flushInterval: v.GetDuration(gostatsd.ParamFlushInterval),
+		port:          port,
+		in:            make(chan []*statsd.Datagram),
+		pending:       gostatsd.NewMetricMap(false),
+		metrics:       make(map[string]*metricStats),
+	}
+
+	if a.flushInterval <= 0 {
+		return nil, fmt.Errorf("invalid %s. Value: %s", gostatsd.ParamFlushInterval, a.flushInterval)
+	}
+
+	a.backend.OnTagValuesRewritten(a.rewritten)
+
+	return a.run(ctx, r)
+}
+
+// defaultBackendName returns the shared backend if its rate limit is enabled, or the first backend with the rate
+// limit enabled otherwise.
+func defaultBackendName(v *viper.Viper) string {
+	names := append([]string{config.SharedBackendName}, v.GetStringSlice(gostatsd.ParamBackends)...)
+
+	for _, name := range names {
+		if util.GetSubViper(util.GetSubViper(v, name), config.ParamRateLimit).GetBool(config.ParamEnabled) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// recordSeries records the series offered to the backend in a flush, and whether they were dropped.
+func recordSeries[T any](a *analyzer, offered map[string]map[string]T, admitted map[string]map[string]T) {
+	for metricName, series := range offered {
+		stats, ok := a.metrics[metricName]
+
+		if !ok {
+			stats = &metricStats{
+				series:    make(map[string]bool),
+				tagValues: make(map[string]map[string]struct{}),
+			}
+
+			a.metrics[metricName] = stats
+		}
+
+		for tagsKey := range series {
+			admittedTagsKey := tagsKey
+
+			if newTagsKey, ok := a.rewrites[metricName][tagsKey]; ok {
+				admittedTagsKey = newTagsKey
+			}
+
+			_, ok := admitted[metricName][admittedTagsKey]
+
+			stats.add(tagsKey, !ok)
+		}
+	}
+}
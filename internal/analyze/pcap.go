@@ -0,0 +1,243 @@
+package analyze
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Constants
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	pcapNGMagic     = 0x0a0d0d0a
+
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+
+	protocolUDP = 17
+)
+
+// Structs
+
+// packet is the payload of a UDP datagram of a capture.
+type packet struct {
+	timestamp time.Time
+	source    string
+	payload   []byte
+}
+
+// pcapReader reads the UDP datagrams sent to a port from a capture in the classic pcap format, as written by tcpdump.
+// Fragmented datagrams are skipped.
+type pcapReader struct {
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+	port     int
+}
+
+// next returns the next UDP datagram sent to the port, or to any port if the port is zero, or io.EOF at the end of
+// the capture.
+func (p *pcapReader) next() (packet, error) {
+	header := make([]byte, 16)
+
+	for {
+		if _, err := io.ReadFull(p.r, header); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return packet{}, io.EOF
+			}
+
+			return packet{}, err
+		}
+
+		seconds := int64(p.order.Uint32(header[0:4]))
+		fraction := int64(p.order.Uint32(header[4:8]))
+		data := make([]byte, p.order.Uint32(header[8:12]))
+
+		if _, err := io.ReadFull(p.r, data); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return packet{}, io.EOF
+			}
+
+			return packet{}, err
+		}
+
+		if !p.nanos {
+			fraction *= int64(time.Microsecond)
+		}
+
+		source, port, payload, ok := udpPayload(p.linkType, data)
+
+		if !ok || (p.port != 0 && port != p.port) {
+			continue
+		}
+
+		return packet{timestamp: time.Unix(seconds, fraction), source: source, payload: payload}, nil
+	}
+}
+
+// Static functions
+
+// isPcap returns whether the given first bytes of a file are the ones of a capture.
+func isPcap(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+
+	m := binary.LittleEndian.Uint32(magic)
+
+	switch m {
+	case pcapMagicMicros, pcapMagicNanos, pcapNGMagic:
+		return true
+	}
+
+	m = binary.BigEndian.Uint32(magic)
+
+	return m == pcapMagicMicros || m == pcapMagicNanos
+}
+
+func newPcapReader(r *bufio.Reader, port int) (*pcapReader, error) {
+	header := make([]byte, 24)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read the pcap header: %w", err)
+	}
+
+	p := &pcapReader{
+		r:    r,
+		port: port,
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header[0:4]) {
+		case pcapMagicMicros:
+			p.order = order
+		case pcapMagicNanos:
+			p.order = order
+			p.nanos = true
+		case pcapNGMagic:
+			return nil, errors.New("pcapng captures are not supported. Convert it with: editcap -F pcap <in> <out>")
+		}
+
+		if p.order != nil {
+			break
+		}
+	}
+
+	if p.order == nil {
+		return nil, errors.New("not a pcap capture")
+	}
+
+	p.linkType = p.order.Uint32(header[20:24]) & 0x0fffffff
+
+	switch p.linkType {
+	case linkTypeNull, linkTypeEthernet, linkTypeRaw, linkTypeLoop, linkTypeLinuxSLL, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return nil, fmt.Errorf("invalid pcap link type. Value: %d", p.linkType)
+	}
+
+	return p, nil
+}
+
+// udpPayload returns the source address, the destination port and the payload of a UDP datagram in the given frame.
+func udpPayload(linkType uint32, frame []byte) (string, int, []byte, bool) {
+	var ip []byte
+
+	switch linkType {
+	case linkTypeNull, linkTypeLoop:
+		if len(frame) < 4 {
+			return "", 0, nil, false
+		}
+
+		ip = frame[4:]
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return "", 0, nil, false
+		}
+
+		etherType := binary.BigEndian.Uint16(frame[12:14])
+		ip = frame[14:]
+
+		if etherType == etherTypeVLAN {
+			if len(ip) < 4 {
+				return "", 0, nil, false
+			}
+
+			etherType = binary.BigEndian.Uint16(ip[2:4])
+			ip = ip[4:]
+		}
+
+		if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+			return "", 0, nil, false
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return "", 0, nil, false
+		}
+
+		ip = frame[16:]
+	default:
+		ip = frame
+	}
+
+	if len(ip) == 0 {
+		return "", 0, nil, false
+	}
+
+	var source net.IP
+	var udp []byte
+
+	switch ip[0] >> 4 {
+	case 4:
+		headerLength := int(ip[0]&0x0f) * 4
+
+		if len(ip) < 20 || len(ip) < headerLength || ip[9] != protocolUDP {
+			return "", 0, nil, false
+		}
+
+		// More fragments, or not the first one
+
+		if flags := binary.BigEndian.Uint16(ip[6:8]); flags&0x2000 != 0 || flags&0x1fff != 0 {
+			return "", 0, nil, false
+		}
+
+		source = net.IP(ip[12:16])
+		udp = ip[headerLength:]
+	case 6:
+		if len(ip) < 40 || ip[6] != protocolUDP {
+			return "", 0, nil, false
+		}
+
+		source = net.IP(ip[8:24])
+		udp = ip[40:]
+	default:
+		return "", 0, nil, false
+	}
+
+	if len(udp) < 8 {
+		return "", 0, nil, false
+	}
+
+	length := min(int(binary.BigEndian.Uint16(udp[4:6])), len(udp))
+
+	if length < 8 {
+		return "", 0, nil, false
+	}
+
+	return source.String(), int(binary.BigEndian.Uint16(udp[2:4])), udp[8:length], true
+}
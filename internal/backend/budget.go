@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"math"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/config"
+)
+
+// Constants
+
+// seriesKeySeparator separates the metric name from the tags key in the total limit tracker. Metric names can't
+// contain it, as it's the separator of the statsd line protocol.
+const seriesKeySeparator = "|"
+
+// Structs
+
+// totalBudget limits the series of all the metric names together. With the priority policy, the last reserve percent
+// of the total limit is kept for the higher priorities: every priority can use the total limit until it runs short,
+// then the lowest priority is the first one to lose out, and the highest priority can use all of it.
+type totalBudget struct {
+	limit       uint64
+	policy      string
+	reserve     uint64
+	maxPriority int
+}
+
+func (b *totalBudget) enabled() bool {
+	return b.limit > 0
+}
+
+// limitFor returns the part of the total limit that the series with the given priority can use, which is all of it
+// but the share of the reserve kept for the higher priorities.
+func (b *totalBudget) limitFor(priority int) uint64 {
+	if b.policy != config.TotalLimitPolicyPriority || b.maxPriority == 0 {
+		return b.limit
+	}
+
+	reserved := b.limit * b.reserve / 100
+
+	return b.limit - reserved*uint64(b.maxPriority-min(priority, b.maxPriority))/uint64(b.maxPriority)
+}
+
+// totalEstimates returns the estimated number of series of all the metric names together, by tenant. Without
+// tenants, the only tenant is an empty string.
+func (b *RateLimitedBackend) totalEstimates() map[string]uint64 {
+	totals := make(map[string]uint64)
+
+	b.hyperLogLogTotal.each(func(tenant string, estimate uint64, _ uint64) {
+		totals[tenant] = estimate
+	})
+
+	return totals
+}
+
+// admit checks the limit of the metric name of a series and then the total limit of its tenant, returning whether
+// it's admitted. The priority class of the series, if any, overrides the priority of its metric name.
+func (b *RateLimitedBackend) admit(settings *rateLimitSettings, offenders offendersBatch, metricName string, tagsKey string, tags gostatsd.Tags) bool {
+	tenant := b.tenantOf(settings, metricName, tags)
+	limits, budget := settings.limitsFor(tenant)
+	limit := limits.resolve(metricName)
+	key := tenantKey(tenant, metricName)
+
+	// The total tracker is keyed by tenant, and also reports the usage of each tenant, so it's used with tenants even
+	// without a total limit
+
+	trackTotal := budget.enabled() || settings.tenancy.enabled()
+	seriesKey := metricName + seriesKeySeparator + tagsKey
+	metricNameOptions := settings.metricNameKeyOptions(limit.precision)
+
+	if class := settings.priorityClassifier.classify(metricName, tags); class != nil {
+		if class.Critical {
+			b.stats.criticalAdmitted.Add(1)
+
+			// Critical series are admitted without checking any limit, but still count toward them
+
+			b.insertMetricName(offenders, key, tagsKey, tags, math.MaxUint64, metricNameOptions)
+
+			if trackTotal {
+				b.hyperLogLogTotal.insertIfBelow(tenant, seriesKey, math.MaxUint64, settings.keyOptions())
+			}
+
+			return true
+		}
+
+		limit.priority = class.Priority
+	}
+
+	if !trackTotal {
+		admitted, _ := b.insertMetricName(offenders, key, tagsKey, tags, limit.limit, metricNameOptions)
+
+		return admitted
+	}
+
+	totalLimit := uint64(math.MaxUint64)
+
+	if budget.enabled() {
+		totalLimit = budget.limitFor(limit.priority)
+	}
+
+	// The total limit is checked first without inserting the series, so a series it rejects does not use the budget
+	// of its metric name
+
+	if !b.hyperLogLogTotal.admits(tenant, seriesKey, totalLimit) {
+		b.stats.totalDropped.Add(1)
+		offenders.add(key, tagsKey, tags)
+
+		return false
+	}
+
+	admitted, isNew := b.insertMetricName(offenders, key, tagsKey, tags, limit.limit, metricNameOptions)
+
+	if !admitted {
+		return false
+	}
+
+	// The rest of the total limit may have been used by another flush since it was checked, in which case the series
+	// is removed from its metric name, so it does not use its budget
+
+	if admitted, _ := b.hyperLogLogTotal.insertIfBelow(tenant, seriesKey, totalLimit, settings.keyOptions()); !admitted {
+		b.stats.totalDropped.Add(1)
+		if isNew {
+			b.hyperLogLogByMetricName.remove(key, tagsKey)
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// insertMetricName inserts a series in the tracker of its metric name, and returns whether it's admitted, and whether
+// it's new to the metric name. The series new to the metric name, admitted or not, are recorded in the batch of the
+// top offenders.
+func (b *RateLimitedBackend) insertMetricName(offenders offendersBatch, key string, tagsKey string, tags gostatsd.Tags, limit uint64, options keyOptions) (bool, bool) {
+	admitted, isNew := b.hyperLogLogByMetricName.insertIfBelow(key, tagsKey, limit, options)
+
+	if isNew {
+		offenders.add(key, tagsKey, tags)
+	}
+
+	return admitted, isNew
+}
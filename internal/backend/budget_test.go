@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/spf13/viper"
+)
+
+func TestPriorityBudget(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", 1000)
+	v.Set("rate-limit.total-limit", 100)
+	v.Set("rate-limit.total-limit-policy", config.TotalLimitPolicyPriority)
+	v.Set("rate-limit.total-limit-reserve", 20)
+	v.Set("rate-limit.limit-rules", []any{map[string]any{"pattern": "high.*", "limit": 1000, "priority": 1}})
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+	settings := b.settings.Load()
+
+	// The low priority can use the whole total limit but the reserve, and the high priority the rest of it
+
+	for _, c := range []struct {
+		metricName string
+		series     int
+		admitted   int
+	}{
+		{"low", 100, 80},
+		{"high.metric", 50, 20},
+		{"low.more", 10, 0},
+	} {
+		admitted := 0
+
+		for i := 0; i < c.series; i++ {
+			if b.admit(settings, nil, c.metricName, "series:"+strconv.Itoa(i), nil) {
+				admitted++
+			}
+		}
+
+		if admitted != c.admitted {
+			t.Fatalf("%d series of %s admitted, want %d", admitted, c.metricName, c.admitted)
+		}
+	}
+}
+
+func TestTotalLimitRejectionKeepsMetricNameBudget(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", 5)
+	v.Set("rate-limit.total-limit", 3)
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+	settings := b.settings.Load()
+
+	for i := 0; i < 10; i++ {
+		b.admit(settings, nil, "metric", "series:"+strconv.Itoa(i), gostatsd.Tags{"series:" + strconv.Itoa(i)})
+	}
+
+	b.hyperLogLogByMetricName.each(func(key string, estimate uint64, _ uint64) {
+		if estimate != 3 {
+			t.Fatalf("key %s has %d series, want the 3 admitted by the total limit", key, estimate)
+		}
+	})
+
+	// A series inserted in its metric name and then rejected by the total limit is removed from it
+
+	b.hyperLogLogByMetricName.insertIfBelow("metric", "series:rejected", 5, defaultKeyOptions)
+	b.hyperLogLogByMetricName.remove("metric", "series:rejected")
+
+	if b.hyperLogLogByMetricName.admits("metric", "series:rejected", 3) {
+		t.Fatal("removed series is still known to its metric name")
+	}
+}
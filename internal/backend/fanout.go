@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/config"
+)
+
+// Structs
+
+// FanOutBackend sends the metrics and events to several backends, so they can be rate limited once, before the
+// fan-out, and all of them get the same series. It does not run the backends: they must be run on their own.
+type FanOutBackend struct {
+	backends []gostatsd.Backend
+}
+
+func (f *FanOutBackend) Name() string {
+	return config.SharedBackendName
+}
+
+// SendMetricsAsync sends the metrics to every backend, and calls the callback with the errors of all of them once
+// every backend is done.
+func (f *FanOutBackend) SendMetricsAsync(ctx context.Context, metricMap *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var errs []error
+
+	wg.Add(len(f.backends))
+
+	for _, backend := range f.backends {
+		backend.SendMetricsAsync(ctx, metricMap, func(backendErrs []error) {
+			defer wg.Done()
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			errs = append(errs, backendErrs...)
+		})
+	}
+
+	go func() {
+		wg.Wait()
+
+		callback(errs)
+	}()
+}
+
+func (f *FanOutBackend) SendEvent(ctx context.Context, event *gostatsd.Event) error {
+	var errs []error
+
+	for _, backend := range f.backends {
+		if err := backend.SendEvent(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Static functions
+
+func NewFanOutBackend(backends []gostatsd.Backend) *FanOutBackend {
+	return &FanOutBackend{
+		backends: backends,
+	}
+}
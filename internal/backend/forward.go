@@ -0,0 +1,292 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/comfortablynumb/victor/internal/ring"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Structs
+
+// ForwardingBackend is the edge of a two-tier topology: it hashes the metric name of every series onto a ring of
+// aggregator Victors, and forwards the series as statsd lines to the one that owns it, so each metric name is rate
+// limited by a single aggregator, which makes an exact decision. The ring is rebalanced when its members change, and
+// only the metric names of the members that joined or left move.
+type ForwardingBackend struct {
+	membership   *ring.Membership
+	tcpTransport bool
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	sendTimeout  time.Duration
+	clients      map[string]*forwardClient
+	mutex        *sync.RWMutex
+	logger       logrus.FieldLogger
+}
+
+func (f *ForwardingBackend) Name() string {
+	return config.ForwardBackendName
+}
+
+// Run runs a client for every member of the ring, and rebalances them when the members change.
+func (f *ForwardingBackend) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	defer wg.Wait()
+
+	f.mutex.Lock()
+
+	for _, c := range f.clients {
+		f.startClient(ctx, &wg, c)
+	}
+
+	f.mutex.Unlock()
+
+	f.membership.Run(ctx, func(r *ring.Ring) {
+		f.rebalance(ctx, &wg, r)
+	})
+}
+
+// SendMetricsAsync splits the metrics by the member that owns their metric name, and sends each part to its member.
+// The callback is called with the errors of all of them once every member is done.
+func (f *ForwardingBackend) SendMetricsAsync(ctx context.Context, metricMap *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	r := f.membership.Ring()
+	metricMapsByMember := make(map[string]*gostatsd.MetricMap)
+
+	metricMapOf := func(metricName string) *gostatsd.MetricMap {
+		member := r.Owner(metricName)
+		memberMetricMap, ok := metricMapsByMember[member]
+
+		if !ok {
+			memberMetricMap = gostatsd.NewMetricMap(metricMap.Forwarded)
+			metricMapsByMember[member] = memberMetricMap
+		}
+
+		return memberMetricMap
+	}
+
+	metricMap.Counters.Each(func(metricName, _ string, c gostatsd.Counter) {
+		metricMapOf(metricName).MergeCounter(metricName, forwardedTagsKey(c.Source, c.Tags), c)
+	})
+	metricMap.Gauges.Each(func(metricName, _ string, g gostatsd.Gauge) {
+		metricMapOf(metricName).MergeGauge(metricName, forwardedTagsKey(g.Source, g.Tags), g)
+	})
+	metricMap.Timers.Each(func(metricName, _ string, t gostatsd.Timer) {
+		metricMapOf(metricName).MergeTimer(metricName, forwardedTagsKey(t.Source, t.Tags), t)
+	})
+	metricMap.Sets.Each(func(metricName, _ string, s gostatsd.Set) {
+		metricMapOf(metricName).MergeSet(metricName, forwardedTagsKey(s.Source, s.Tags), s)
+	})
+
+	// The clients are only locked to take the ones of the members, and each send takes its own time, so a slow or
+	// unreachable member doesn't hold back the others, or a rebalance. A client removed by a rebalance is only stopped
+	// once the sends it was taken for are done.
+
+	clients := make(map[string]*forwardClient, len(metricMapsByMember))
+
+	f.mutex.RLock()
+
+	for member := range metricMapsByMember {
+		if c, ok := f.clients[member]; ok {
+			c.sends.Add(1)
+			clients[member] = c
+		}
+	}
+
+	f.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	var errsMutex sync.Mutex
+	var errs []error
+
+	addErrs := func(memberErrs ...error) {
+		errsMutex.Lock()
+		defer errsMutex.Unlock()
+
+		errs = append(errs, memberErrs...)
+	}
+
+	for member, memberMetricMap := range metricMapsByMember {
+		c, ok := clients[member]
+
+		if !ok {
+			addErrs(fmt.Errorf("no client for ring member %s", member))
+
+			continue
+		}
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			defer c.sends.Done()
+
+			sendCtx, cancel := context.WithTimeout(ctx, f.sendTimeout)
+
+			c.sendMetrics(sendCtx, memberMetricMap, func(memberErrs []error) {
+				defer wg.Done()
+				defer cancel()
+
+				for _, err := range memberErrs {
+					if err != nil {
+						addErrs(fmt.Errorf("ring member %s: %w", member, err))
+					}
+				}
+			})
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+
+		callback(errs)
+	}()
+}
+
+// SendEvent sends the event to the member that owns its key, the same one it is rate limited by.
+func (f *ForwardingBackend) SendEvent(ctx context.Context, event *gostatsd.Event) error {
+	eventKey := event.AggregationKey
+
+	if eventKey == "" {
+		eventKey = event.Title
+	}
+
+	member := f.membership.Ring().Owner(eventKey)
+
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	c, ok := f.clients[member]
+
+	if !ok {
+		return fmt.Errorf("no client for ring member %s", member)
+	}
+
+	return c.events.SendEvent(ctx, event)
+}
+
+// rebalance starts a client for every new member of the ring, and stops the clients of the members that left it.
+func (f *ForwardingBackend) rebalance(ctx context.Context, wg *sync.WaitGroup, r *ring.Ring) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	members := make(map[string]struct{})
+
+	for _, member := range r.Members() {
+		members[member] = struct{}{}
+
+		if _, ok := f.clients[member]; ok {
+			continue
+		}
+
+		if c := f.addClient(member); c != nil {
+			f.startClient(ctx, wg, c)
+		}
+	}
+
+	for member, c := range f.clients {
+		if _, ok := members[member]; ok {
+			continue
+		}
+
+		delete(f.clients, member)
+
+		c.stop()
+	}
+}
+
+func (f *ForwardingBackend) addClient(member string) *forwardClient {
+	c, err := newForwardClient(member, f.tcpTransport, f.dialTimeout, f.writeTimeout, f.logger.WithField("member", member))
+
+	if err != nil {
+		f.logger.WithError(err).
+			WithField("member", member).
+			Error("Failed to create the client of a ring member. Its metric names won't be forwarded")
+
+		return nil
+	}
+
+	f.clients[member] = c
+
+	return c
+}
+
+func (f *ForwardingBackend) startClient(ctx context.Context, wg *sync.WaitGroup, c *forwardClient) {
+	clientCtx, cancel := context.WithCancel(ctx)
+
+	c.cancel = cancel
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		c.run(clientCtx)
+	}()
+}
+
+// Static functions
+
+// forwardedTagsKey returns the tags of a forwarded series, as they are written in its statsd lines. The source is sent
+// as a host tag, which the aggregators take as the source of the series when they run with ignore-host, instead of
+// the address of this Victor.
+func forwardedTagsKey(source gostatsd.Source, tags gostatsd.Tags) string {
+	tagsKey := strings.Join(slices.Sorted(slices.Values(tags)), ",")
+
+	if source == "" {
+		return tagsKey
+	}
+
+	if tagsKey != "" {
+		tagsKey += ","
+	}
+
+	return tagsKey + "host:" + string(source)
+}
+
+func NewForwardingBackend(v *viper.Viper, logger logrus.FieldLogger) (*ForwardingBackend, error) {
+	v.SetDefault(config.ParamForwardVirtualNodes, ring.DefaultVirtualNodes)
+	v.SetDefault(config.ParamForwardDialTimeout, config.DefaultForwardDialTimeout)
+	v.SetDefault(config.ParamForwardWriteTimeout, config.DefaultForwardWriteTimeout)
+	v.SetDefault(config.ParamForwardSendTimeout, config.DefaultForwardSendTimeout)
+
+	logger = logger.WithField("backend", config.ForwardBackendName)
+
+	membership, err := ring.NewMembership(
+		v.GetStringSlice(config.ParamForwardMembers),
+		v.GetString(config.ParamForwardMembersFile),
+		v.GetInt(config.ParamForwardVirtualNodes),
+		logger,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s configuration: %w", config.ForwardBackendName, err)
+	}
+
+	logger.WithField("members", membership.Ring().Members()).Info("Forwarding to the ring members")
+
+	f := &ForwardingBackend{
+		membership:   membership,
+		tcpTransport: v.GetBool(config.ParamForwardTCPTransport),
+		dialTimeout:  v.GetDuration(config.ParamForwardDialTimeout),
+		writeTimeout: v.GetDuration(config.ParamForwardWriteTimeout),
+		sendTimeout:  v.GetDuration(config.ParamForwardSendTimeout),
+		clients:      make(map[string]*forwardClient),
+		mutex:        &sync.RWMutex{},
+		logger:       logger,
+	}
+
+	for _, member := range membership.Ring().Members() {
+		f.addClient(member)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestForwardedLines(t *testing.T) {
+	metricMap := gostatsd.NewMetricMap(false)
+	tags := gostatsd.Tags{"a:1"}
+
+	metricMap.MergeCounter("counter", "a:1", gostatsd.NewCounter(0, 5, "", tags))
+	metricMap.MergeCounter("statsd.internal", "", gostatsd.NewCounter(0, 1, "", nil))
+	metricMap.MergeGauge("gauge", "", gostatsd.NewGauge(0, 1.5, "", nil))
+
+	// A timer sampled at 0.5 counts twice its values
+
+	timer := gostatsd.NewTimer(0, []float64{1, 2}, "", tags)
+	timer.SampledCount = 4
+
+	metricMap.MergeTimer("timer", "a:1", timer)
+	metricMap.MergeTimer("unsampled", "", gostatsd.NewTimer(0, []float64{3}, "", nil))
+
+	var lines []string
+
+	eachForwardedLine(metricMap, func(line string) {
+		lines = append(lines, line)
+	})
+
+	slices.Sort(lines)
+
+	want := []string{
+		"counter:5|c|#a:1\n",
+		"gauge:1.5|g\n",
+		"timer:1|ms|@0.5|#a:1\n",
+		"timer:2|ms|@0.5|#a:1\n",
+		"unsampled:3|ms\n",
+	}
+
+	if !slices.Equal(lines, want) {
+		t.Fatalf("lines are %q, want %q", lines, want)
+	}
+}
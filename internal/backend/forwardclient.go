@@ -0,0 +1,193 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/sender"
+	"github.com/atlassian/gostatsd/pkg/backends/statsdaemon"
+	"github.com/sirupsen/logrus"
+)
+
+// Constants
+
+const (
+	forwardUDPPacketSize = 1472
+	forwardTCPPacketSize = 1024 * 1024
+	// forwardSendChannelSize is the number of buffers of lines a send can prepare ahead of the ones written.
+	forwardSendChannelSize = 1000
+	// forwardMaxConcurrentSends is the number of sends to a member that can be queued before they block.
+	forwardMaxConcurrentSends = 10
+)
+
+// Structs
+
+// forwardClient is the client of a ring member. It is created along with the backend, so events can be sent before
+// the backend runs, but it only sends metrics once it runs too. The metrics are written as statsd lines with gostatsd's
+// sender, keeping the sample rate of the timers, and the events are sent with gostatsd's statsdaemon client.
+type forwardClient struct {
+	sender     *sender.Sender
+	events     *statsdaemon.Client
+	packetSize int
+	cancel     context.CancelFunc
+	// sends are the sends in flight, which must be done before the client is stopped, as its sender can't be used
+	// once it's stopped.
+	sends sync.WaitGroup
+}
+
+func (c *forwardClient) run(ctx context.Context) {
+	c.sender.Run(ctx)
+}
+
+// stop stops the client once its sends in flight are done. The client must have been removed from the clients first,
+// so no new send starts.
+func (c *forwardClient) stop() {
+	go func() {
+		c.sends.Wait()
+
+		if c.cancel != nil {
+			c.cancel()
+		}
+	}()
+}
+
+// sendMetrics writes the metrics as statsd lines, and hands them over to the sender, which calls the callback once
+// they are written. It gives up when the context is done.
+func (c *forwardClient) sendMetrics(ctx context.Context, metricMap *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	sink := make(chan *bytes.Buffer, forwardSendChannelSize)
+
+	select {
+	case <-ctx.Done():
+		callback([]error{ctx.Err()})
+
+		return
+	case c.sender.Sink <- sender.Stream{Ctx: ctx, Cb: callback, Buf: sink}:
+	}
+
+	defer close(sink)
+
+	buf := c.sender.GetBuffer()
+
+	// flush hands the buffer over once the next line doesn't fit in it, and returns false if the context is done
+
+	flush := func(next int) bool {
+		if buf.Len() == 0 || buf.Len()+next <= c.packetSize {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			c.sender.PutBuffer(buf)
+
+			return false
+		case sink <- buf:
+			buf = c.sender.GetBuffer()
+
+			return true
+		}
+	}
+
+	done := false
+
+	eachForwardedLine(metricMap, func(line string) {
+		if !done && flush(len(line)) {
+			buf.WriteString(line)
+		} else {
+			done = true
+		}
+	})
+
+	if !done && flush(c.packetSize+1) {
+		c.sender.PutBuffer(buf)
+	}
+}
+
+// Static functions
+
+// eachForwardedLine calls f with every statsd line of the metrics. The timers are sent with their sample rate, so the
+// aggregators count them the same. The statsd internal counters are not sent, as the aggregators compute their own.
+func eachForwardedLine(metricMap *gostatsd.MetricMap, f func(line string)) {
+	line := func(metricName string, value string, metricType string, sampleRate float64, tagsKey string) string {
+		var b strings.Builder
+
+		b.WriteString(metricName + ":" + value + "|" + metricType)
+
+		if sampleRate > 0 && sampleRate < 1 {
+			b.WriteString("|@" + strconv.FormatFloat(sampleRate, 'g', -1, 64))
+		}
+
+		if tagsKey != "" {
+			b.WriteString("|#" + tagsKey)
+		}
+
+		b.WriteString("\n")
+
+		return b.String()
+	}
+
+	metricMap.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if !strings.HasPrefix(metricName, "statsd.") {
+			f(line(metricName, strconv.FormatInt(c.Value, 10), "c", 0, tagsKey))
+		}
+	})
+	metricMap.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		sampleRate := 0.0
+
+		if t.SampledCount > 0 {
+			sampleRate = float64(len(t.Values)) / t.SampledCount
+		}
+
+		for _, value := range t.Values {
+			f(line(metricName, strconv.FormatFloat(value, 'f', -1, 64), "ms", sampleRate, tagsKey))
+		}
+	})
+	metricMap.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		f(line(metricName, strconv.FormatFloat(g.Value, 'f', -1, 64), "g", 0, tagsKey))
+	})
+	metricMap.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		for value := range s.Values {
+			f(line(metricName, value, "s", 0, tagsKey))
+		}
+	})
+}
+
+func newForwardClient(member string, tcpTransport bool, dialTimeout time.Duration, writeTimeout time.Duration, logger logrus.FieldLogger) (*forwardClient, error) {
+	events, err := statsdaemon.NewClient(member, dialTimeout, writeTimeout, false, tcpTransport, nil, logger)
+
+	if err != nil {
+		return nil, err
+	}
+
+	network, packetSize := "udp", forwardUDPPacketSize
+
+	if tcpTransport {
+		network, packetSize = "tcp", forwardTCPPacketSize
+	}
+
+	return &forwardClient{
+		sender: &sender.Sender{
+			Logger: logger,
+			ConnFactory: func() (net.Conn, error) {
+				return net.DialTimeout(network, member, dialTimeout)
+			},
+			Sink: make(chan sender.Stream, forwardMaxConcurrentSends),
+			BufPool: sync.Pool{
+				New: func() any {
+					buf := new(bytes.Buffer)
+					buf.Grow(packetSize)
+
+					return buf
+				},
+			},
+			WriteTimeout: writeTimeout,
+		},
+		events:     events,
+		packetSize: packetSize,
+	}, nil
+}
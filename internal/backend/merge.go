@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"math"
+	"sort"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/config"
+)
+
+// Static functions
+
+func mergeCounter(into gostatsd.Counter, from gostatsd.Counter) gostatsd.Counter {
+	into.Value += from.Value
+	into.PerSecond += from.PerSecond
+	into.Timestamp = max(into.Timestamp, from.Timestamp)
+
+	return into
+}
+
+func mergeGauge(into gostatsd.Gauge, from gostatsd.Gauge, rule string) gostatsd.Gauge {
+	switch rule {
+	case config.GaugeMergeMax:
+		into.Value = math.Max(into.Value, from.Value)
+	case config.GaugeMergeMin:
+		into.Value = math.Min(into.Value, from.Value)
+	case config.GaugeMergeSum:
+		into.Value += from.Value
+	default:
+		if from.Timestamp > into.Timestamp {
+			into.Value = from.Value
+		}
+	}
+
+	into.Timestamp = max(into.Timestamp, from.Timestamp)
+
+	return into
+}
+
+// mergeTimer merges two already aggregated timers, recalculating the aggregations from the merged values.
+// Percentiles can't be recalculated, as we don't know the configured thresholds, so they are discarded.
+func mergeTimer(into gostatsd.Timer, from gostatsd.Timer) gostatsd.Timer {
+	values := make([]float64, 0, len(into.Values)+len(from.Values))
+	values = append(values, into.Values...)
+	values = append(values, from.Values...)
+
+	sort.Float64s(values)
+
+	into.Values = values
+	into.Count += from.Count
+	into.SampledCount += from.SampledCount
+	into.PerSecond += from.PerSecond
+	into.Sum += from.Sum
+	into.SumSquares += from.SumSquares
+	into.Timestamp = max(into.Timestamp, from.Timestamp)
+	into.Percentiles = nil
+
+	if n := len(values); n > 0 {
+		count := float64(n)
+
+		into.Min = values[0]
+		into.Max = values[n-1]
+		into.Mean = into.Sum / count
+		into.StdDev = math.Sqrt(math.Max(into.SumSquares/count-into.Mean*into.Mean, 0))
+
+		if n%2 == 0 {
+			into.Median = (values[n/2-1] + values[n/2]) / 2
+		} else {
+			into.Median = values[n/2]
+		}
+	}
+
+	if len(from.Histogram) > 0 {
+		histogram := make(map[gostatsd.HistogramThreshold]int, len(into.Histogram))
+
+		for threshold, count := range into.Histogram {
+			histogram[threshold] += count
+		}
+
+		for threshold, count := range from.Histogram {
+			histogram[threshold] += count
+		}
+
+		into.Histogram = histogram
+	}
+
+	return into
+}
+
+func mergeSet(into gostatsd.Set, from gostatsd.Set) gostatsd.Set {
+	values := make(map[string]struct{}, len(into.Values)+len(from.Values))
+
+	for value := range into.Values {
+		values[value] = struct{}{}
+	}
+
+	for value := range from.Values {
+		values[value] = struct{}{}
+	}
+
+	into.Values = values
+	into.Timestamp = max(into.Timestamp, from.Timestamp)
+
+	return into
+}
@@ -0,0 +1,292 @@
+package backend
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/hyperloglog"
+	"github.com/comfortablynumb/victor/internal/spacesaving"
+	"github.com/sirupsen/logrus"
+)
+
+// Constants
+
+const (
+	// offendersCapacityFactor is how many more metric names than reported are counted, so the counts of the reported
+	// ones are accurate.
+	offendersCapacityFactor = 10
+	// maxOffenderTagKeys is the maximum number of tag keys counted by metric name.
+	maxOffenderTagKeys = 64
+	// offenderPrecision is the precision of the sketches of the series and of the tag keys, which take 1KB at most.
+	offenderPrecision = 10
+)
+
+// Structs
+
+type TagKeyOffender struct {
+	TagKey string `json:"tag_key"`
+	Values uint64 `json:"values"`
+}
+
+// MetricOffender is a metric name with the most distinct series in the current window, admitted or dropped, and its
+// tag keys with the most distinct values. NewSeries overestimates the estimated count by at most Error.
+type MetricOffender struct {
+	Tenant     string           `json:"tenant,omitempty"`
+	MetricName string           `json:"metric_name"`
+	NewSeries  uint64           `json:"new_series"`
+	Error      uint64           `json:"error"`
+	TagKeys    []TagKeyOffender `json:"tag_keys"`
+}
+
+// offenderSketches counts the distinct series of a metric name in the top offenders, and the distinct values of each
+// of its tag keys.
+type offenderSketches struct {
+	series  *hyperloglog.HyperLogLog
+	tagKeys map[string]*hyperloglog.HyperLogLog
+}
+
+// topOffenders finds the metric names with the most distinct series with a Space-Saving summary. The metric names in
+// the summary count their distinct series, and the distinct values of each tag key, with a small sketch each, and add
+// to the summary by how much their series sketch grows, so a series sent again, even if it's dropped every time, only
+// counts once. Its memory is bounded no matter how many metric names and tag values there are. The new series of a
+// flush are batched, so the summary is locked once by flush instead of once by series.
+type topOffenders struct {
+	n             int
+	metricNames   *spacesaving.Summary
+	sketchesByKey map[string]*offenderSketches
+	mutex         *sync.Mutex
+}
+
+func (o *topOffenders) enabled() bool {
+	return o.n > 0
+}
+
+// batchedOffender holds the hashes of the new series of a key in a flush, and of the values of its tag keys.
+type batchedOffender struct {
+	series         []uint64
+	tagValuesByKey map[string][]uint64
+}
+
+// offendersBatch holds the new series of a flush by key, until they are added to the top offenders. A nil batch
+// discards them, as the top offenders are disabled.
+type offendersBatch map[string]*batchedOffender
+
+// add records a series new to its key.
+func (b offendersBatch) add(key string, tagsKey string, tags gostatsd.Tags) {
+	if b == nil {
+		return
+	}
+
+	offender, ok := b[key]
+
+	if !ok {
+		offender = &batchedOffender{tagValuesByKey: make(map[string][]uint64)}
+		b[key] = offender
+	}
+
+	offender.series = append(offender.series, hyperloglog.Hash(tagsKey))
+
+	for _, tag := range tags {
+		tagKey, tagValue, _ := strings.Cut(tag, tagKeyValueSplit)
+
+		if _, ok := offender.tagValuesByKey[tagKey]; !ok && len(offender.tagValuesByKey) >= maxOffenderTagKeys {
+			continue
+		}
+
+		offender.tagValuesByKey[tagKey] = append(offender.tagValuesByKey[tagKey], hyperloglog.Hash(tagValue))
+	}
+}
+
+// newBatch returns an empty batch for the new series of a flush, or nil if the top offenders are not enabled.
+func (o *topOffenders) newBatch() offendersBatch {
+	if !o.enabled() {
+		return nil
+	}
+
+	return make(offendersBatch)
+}
+
+// addBatch records the new series of a flush.
+func (o *topOffenders) addBatch(batch offendersBatch) {
+	if len(batch) == 0 {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for key, offender := range batch {
+		sketches, ok := o.sketchesByKey[key]
+
+		if !ok {
+			sketches = &offenderSketches{
+				series:  hyperloglog.NewEmptyHyperLogLog(0, offenderPrecision),
+				tagKeys: make(map[string]*hyperloglog.HyperLogLog),
+			}
+		}
+
+		before := sketches.series.Estimate()
+
+		for _, hash := range offender.series {
+			sketches.series.InsertHash(hash)
+		}
+
+		if after := sketches.series.Estimate(); after > before || !ok {
+			if evicted, ok := o.metricNames.Add(key, after-min(before, after)); ok {
+				delete(o.sketchesByKey, evicted)
+			}
+		}
+
+		o.sketchesByKey[key] = sketches
+
+		for tagKey, hashes := range offender.tagValuesByKey {
+			sketch, ok := sketches.tagKeys[tagKey]
+
+			if !ok {
+				if len(sketches.tagKeys) >= maxOffenderTagKeys {
+					continue
+				}
+
+				sketch = hyperloglog.NewEmptyHyperLogLog(0, offenderPrecision)
+				sketches.tagKeys[tagKey] = sketch
+			}
+
+			for _, hash := range hashes {
+				sketch.InsertHash(hash)
+			}
+		}
+	}
+}
+
+// top returns the n metric names with the most distinct series, each one with its n tag keys with the most distinct
+// values.
+func (o *topOffenders) top() []MetricOffender {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	counters := o.metricNames.Top(o.n)
+	offenders := make([]MetricOffender, 0, len(counters))
+
+	for _, c := range counters {
+		tenant, metricName := splitTenantKey(c.Key)
+		tagKeys := make([]TagKeyOffender, 0, len(o.sketchesByKey[c.Key].tagKeys))
+
+		for tagKey, sketch := range o.sketchesByKey[c.Key].tagKeys {
+			tagKeys = append(tagKeys, TagKeyOffender{TagKey: tagKey, Values: sketch.Estimate()})
+		}
+
+		slices.SortFunc(tagKeys, func(a, b TagKeyOffender) int {
+			return cmp.Or(cmp.Compare(b.Values, a.Values), cmp.Compare(a.TagKey, b.TagKey))
+		})
+
+		offenders = append(offenders, MetricOffender{
+			Tenant:     tenant,
+			MetricName: metricName,
+			NewSeries:  c.Count,
+			Error:      c.Error,
+			TagKeys:    tagKeys[:min(o.n, len(tagKeys))],
+		})
+	}
+
+	return offenders
+}
+
+func (o *topOffenders) clear() {
+	if !o.enabled() {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.metricNames.Reset()
+
+	o.sketchesByKey = make(map[string]*offenderSketches)
+}
+
+// decay makes the counts of the summary weigh less by the given factor, as the window slides, so the metric names that
+// stopped growing sink below the ones growing now. Their sketches are kept, so their series still count only once,
+// until the whole window slid.
+func (o *topOffenders) decay(factor float64) {
+	if factor <= 0 {
+		o.clear()
+
+		return
+	}
+
+	if !o.enabled() {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.metricNames.Decay(factor)
+}
+
+// TopOffenders returns the metric names with the most distinct series in the current window, and their tag keys with the
+// most distinct values, or false if the top offenders are not enabled.
+func (b *RateLimitedBackend) TopOffenders() ([]MetricOffender, bool) {
+	if !b.offenders.enabled() {
+		return nil, false
+	}
+
+	return b.offenders.top(), true
+}
+
+// runOffendersLog logs the top offenders periodically, until the context is done.
+func (b *RateLimitedBackend) runOffendersLog(ctx context.Context) {
+	ticker := time.NewTicker(b.offendersLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.logOffenders()
+		}
+	}
+}
+
+func (b *RateLimitedBackend) logOffenders() {
+	offenders := b.offenders.top()
+
+	if len(offenders) == 0 {
+		return
+	}
+
+	top := make([]string, 0, len(offenders))
+
+	for _, offender := range offenders {
+		tagKeys := make([]string, 0, len(offender.TagKeys))
+
+		for _, tagKey := range offender.TagKeys {
+			tagKeys = append(tagKeys, fmt.Sprintf("%s=%d", tagKey.TagKey, tagKey.Values))
+		}
+
+		top = append(top, fmt.Sprintf("%s=%d[%s]", tenantKey(offender.Tenant, offender.MetricName), offender.NewSeries, strings.Join(tagKeys, ",")))
+	}
+
+	logrus.WithField("backend", b.Name()).
+		WithField("top", strings.Join(top, " ")).
+		Info("Top cardinality offenders")
+}
+
+// Static functions
+
+// newTopOffenders returns the top n offenders. A zero n disables them.
+func newTopOffenders(n int) *topOffenders {
+	return &topOffenders{
+		n:             n,
+		metricNames:   spacesaving.New(n * offendersCapacityFactor),
+		sketchesByKey: make(map[string]*offenderSketches),
+		mutex:         &sync.Mutex{},
+	}
+}
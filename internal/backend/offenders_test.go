@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/spf13/viper"
+)
+
+func TestTopOffenders(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", 100)
+	v.Set("rate-limit.top-offenders", 1)
+	v.Set("rate-limit.window", "sliding")
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+	metricMap, _ := newMetricMaps(1000, 2, 1)
+
+	send(b, metricMap)
+
+	offenders, _ := b.TopOffenders()
+	first := offenders[0].NewSeries
+
+	// Every series counts, admitted or rejected, within the error of the sketch
+
+	if len(offenders) != 1 || first < 450 || first > 550 || offenders[0].TagKeys[0].TagKey != "series" {
+		t.Fatalf("top offenders are %+v, want a metric name with about 500 series by its series tag", offenders)
+	}
+
+	send(b, metricMap)
+
+	if offenders, _ := b.TopOffenders(); offenders[0].NewSeries != first {
+		t.Fatalf("top offender has %d series after sending them again, want %d", offenders[0].NewSeries, first)
+	}
+
+	b.rotateHyperLogLogs(1)
+
+	decayed := first * 5 / 6
+
+	if offenders, _ := b.TopOffenders(); len(offenders) != 1 || offenders[0].NewSeries != decayed {
+		t.Fatalf("top offenders are %+v after the window slid, want a metric name with %d series", offenders, decayed)
+	}
+
+	b.rateLimit(b.settings.Load(), newCounters("metric", 3))
+
+	if offenders, _ := b.TopOffenders(); len(offenders) != 1 || offenders[0].NewSeries != decayed {
+		t.Fatalf("top offenders are %+v, want the metric name with %d series still on top", offenders, decayed)
+	}
+
+	b.rotateHyperLogLogs(6)
+
+	b.rateLimit(b.settings.Load(), newCounters("metric", 3))
+
+	if offenders, _ := b.TopOffenders(); len(offenders) != 1 || offenders[0].NewSeries != 3 {
+		t.Fatalf("top offenders are %+v after the whole window slid, want a metric name with 3 series", offenders)
+	}
+}
+
+func newCounters(metricName string, series int) *gostatsd.MetricMap {
+	metricMap := gostatsd.NewMetricMap(false)
+
+	for i := 0; i < series; i++ {
+		tags := gostatsd.Tags{"series:" + strconv.Itoa(i)}
+
+		metricMap.MergeCounter(metricName, tags[0], gostatsd.NewCounter(0, 1, "", tags))
+	}
+
+	return metricMap
+}
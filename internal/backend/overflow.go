@@ -0,0 +1,154 @@
+package backend
+
+import (
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// Constants
+
+const (
+	OverflowTag      = "victor_overflow:true"
+	OverflowTagValue = "__overflow__"
+)
+
+// Types
+
+// rejectedSeries holds the tags keys of the series that were over the limit, by metric name.
+type rejectedSeries map[string][]string
+
+func (r rejectedSeries) add(metricName string, tagsKey string) {
+	r[metricName] = append(r[metricName], tagsKey)
+}
+
+func (r rejectedSeries) len() int {
+	count := 0
+
+	for _, tagsKeys := range r {
+		count += len(tagsKeys)
+	}
+
+	return count
+}
+
+// overflowTags returns the tags of the overflow series of a rejected series: its tag keys, sorted, with their values
+// replaced by a placeholder, plus the overflow tag, so the rejected series with the same tag keys end up in the same
+// series on every flush. The tenant tag keeps its value when the rejected series counted toward a tenant other than the
+// default.
+func (b *RateLimitedBackend) overflowTags(settings *rateLimitSettings, metricName string, tags gostatsd.Tags) gostatsd.Tags {
+	tenantTag := b.overflowTenantTag(settings, metricName, tags)
+	overflowTags := make(gostatsd.Tags, 0, len(tags)+1)
+
+	for _, tag := range tags {
+		tagKey, _, _ := strings.Cut(tag, tagKeyValueSplit)
+
+		if tenantTag != "" && tagKey == settings.tenancy.tag {
+			overflowTags = append(overflowTags, tenantTag)
+		} else {
+			overflowTags = append(overflowTags, tagKey+tagKeyValueSplit+OverflowTagValue)
+		}
+	}
+
+	slices.Sort(overflowTags)
+
+	return append(slices.Compact(overflowTags), OverflowTag)
+}
+
+// overflowTenantTag returns the tenant tag of a rejected series if it counted toward a tenant other than the default,
+// or an empty string otherwise.
+func (b *RateLimitedBackend) overflowTenantTag(settings *rateLimitSettings, metricName string, tags gostatsd.Tags) string {
+	t := settings.tenancy
+
+	if t.tag == "" {
+		return ""
+	}
+
+	tenant := t.tenantOf(metricName, tags)
+
+	if tenant == t.defaultTenant {
+		return ""
+	}
+
+	// The series of a tenant folded into the default tenant were counted toward it
+
+	if _, tracked := b.hyperLogLogTotal.get(tenant); !tracked && !t.listed(tenant) {
+		return ""
+	}
+
+	return t.tag + tagKeyValueSplit + tenant
+}
+
+// countOverflow counts an overflow series toward the limit of its metric name and the total limit of its tenant,
+// without checking them, as critical series are.
+func (b *RateLimitedBackend) countOverflow(settings *rateLimitSettings, metricName string, tagsKey string, tags gostatsd.Tags) {
+	tenant := b.tenantOf(settings, metricName, tags)
+	limits, budget := settings.limitsFor(tenant)
+	options := settings.metricNameKeyOptions(limits.resolve(metricName).precision)
+
+	b.hyperLogLogByMetricName.insertIfBelow(tenantKey(tenant, metricName), tagsKey, math.MaxUint64, options)
+
+	if budget.enabled() || settings.tenancy.enabled() {
+		b.hyperLogLogTotal.insertIfBelow(tenant, metricName+seriesKeySeparator+tagsKey, math.MaxUint64, settings.keyOptions())
+	}
+}
+
+// Static functions
+
+// countRejectedValues returns the number of values of the rejected series.
+func countRejectedValues[T any](metrics map[string]map[string]T, rejected rejectedSeries, accessor seriesAccessor[T]) uint64 {
+	count := uint64(0)
+
+	for metricName, tagsKeys := range rejected {
+		for _, tagsKey := range tagsKeys {
+			count += uint64(accessor.values(metrics[metricName][tagsKey]))
+		}
+	}
+
+	return count
+}
+
+func dropRejectedSeries(metrics gostatsd.AggregatedMetrics, rejected rejectedSeries) {
+	for metricName, tagsKeys := range rejected {
+		for _, tagsKey := range tagsKeys {
+			dropSeries(metrics, metricName, tagsKey)
+		}
+	}
+}
+
+// overflowRejectedSeries replaces the rejected series of each metric name with an overflow series by set of tag keys,
+// merging their values, so totals stay correct while cardinality stays bounded. With a tenant tag, there is one by
+// tenant too. The overflow series count toward the limits, but are always admitted.
+func overflowRejectedSeries[T any](b *RateLimitedBackend, settings *rateLimitSettings, metrics map[string]map[string]T, rejected rejectedSeries, accessor seriesAccessor[T]) {
+	for metricName, tagsKeys := range rejected {
+		series := metrics[metricName]
+		mergedByTagsKey := make(map[string]T)
+		tagsByTagsKey := make(map[string]gostatsd.Tags)
+
+		for _, tagsKey := range tagsKeys {
+			value := series[tagsKey]
+
+			delete(series, tagsKey)
+
+			tags := b.overflowTags(settings, metricName, accessor.tags(value))
+			overflowTagsKey := gostatsd.FormatTagsKey("", tags)
+
+			if merged, ok := mergedByTagsKey[overflowTagsKey]; ok {
+				mergedByTagsKey[overflowTagsKey] = accessor.merge(merged, value)
+			} else {
+				mergedByTagsKey[overflowTagsKey] = value
+				tagsByTagsKey[overflowTagsKey] = tags
+			}
+		}
+
+		for overflowTagsKey, merged := range mergedByTagsKey {
+			tags := tagsByTagsKey[overflowTagsKey]
+
+			putSeries(metrics, metricName, overflowTagsKey, accessor.setTags(merged, tags, ""), accessor)
+
+			b.countOverflow(settings, metricName, overflowTagsKey, tags)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package backend
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/spf13/viper"
+)
+
+func TestOverflowSeries(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", 2)
+	v.Set("rate-limit.mode", "overflow")
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+
+	// The rejected series end up in an overflow series by tag keys, the same one on every flush
+
+	wantOverflowed := map[string][]int64{"user": {3, 5}, "request": {0, 5}}
+
+	for flush, tagKeys := range [][]string{{"user"}, {"user", "request"}} {
+		metricMap := gostatsd.NewMetricMap(false)
+
+		for _, tagKey := range tagKeys {
+			for i := 0; i < 5; i++ {
+				tags := gostatsd.Tags{tagKey + ":" + strconv.Itoa(flush*10+i)}
+
+				metricMap.MergeCounter("metric", tags[0], gostatsd.NewCounter(0, 1, "", tags))
+			}
+		}
+
+		b.rateLimit(b.settings.Load(), metricMap)
+
+		for _, tagKey := range tagKeys {
+			overflowTagsKey := tagKey + ":" + OverflowTagValue + "," + OverflowTag
+			overflow, ok := metricMap.Counters["metric"][overflowTagsKey]
+
+			if want := wantOverflowed[tagKey][flush]; !ok || overflow.Value != want {
+				t.Fatalf("flush %d: overflow series of %s is %+v, found %t, want %d", flush, tagKey, overflow, ok, want)
+			}
+		}
+	}
+
+	tracked, _ := b.hyperLogLogByMetricName.get("metric")
+
+	if estimate := tracked.estimate(); estimate != 4 {
+		t.Fatalf("estimate is %d, want the limit plus the 2 overflow series", estimate)
+	}
+}
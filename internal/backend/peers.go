@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/comfortablynumb/victor/internal/hyperloglog"
+)
+
+// PeerState returns the cardinality state the backend shares with its peers: the HyperLogLogs of its metric names
+// and of its total limit, in the same format as the state file. Each one is encoded as its exact set of hashes up to
+// the exact threshold, and only as the registers of its sketch past it, so the state doesn't grow with the series.
+func (b *RateLimitedBackend) PeerState() ([]byte, error) {
+	state := persistedState{
+		LastClearTime: atomic.LoadInt64(&b.lastClearTime),
+	}
+
+	var err error
+
+	if state.MetricNames, err = b.hyperLogLogByMetricName.snapshot(false); err != nil {
+		return nil, err
+	}
+
+	if state.Total, err = b.hyperLogLogTotal.snapshot(false); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+
+	if err := gob.NewEncoder(&buffer).Encode(state); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// SetPeerStates merges the cardinality states shared by the peers, so the limits are enforced against the
+// cardinality of the whole cluster. The states of windows that already ended are ignored.
+func (b *RateLimitedBackend) SetPeerStates(peerStates [][]byte) error {
+	metricNames := make(map[string]*hyperloglog.HyperLogLog)
+	total := make(map[string]*hyperloglog.HyperLogLog)
+	windowEnd := time.Now().Add(-b.settings.Load().clearAfterDuration).Unix()
+
+	for _, data := range peerStates {
+		var state persistedState
+
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+			return fmt.Errorf("failed to decode a peer state: %w", err)
+		}
+
+		if state.LastClearTime < windowEnd {
+			continue
+		}
+
+		if err := mergePeerKeys(metricNames, state.MetricNames, b.exactThreshold); err != nil {
+			return err
+		}
+
+		if err := mergePeerKeys(total, state.Total, b.exactThreshold); err != nil {
+			return err
+		}
+	}
+
+	settings := b.settings.Load()
+
+	// The metric names only known to the peers are tracked with the precision of their limit, as if they were seen here
+
+	metricNameOptions := func(key string) keyOptions {
+		tenant, metricName := splitTenantKey(key)
+		limits, _ := settings.limitsFor(tenant)
+
+		return settings.metricNameKeyOptions(limits.resolve(metricName).precision)
+	}
+
+	if err := b.hyperLogLogByMetricName.setPeers(metricNames, metricNameOptions); err != nil {
+		return err
+	}
+
+	return b.hyperLogLogTotal.setPeers(total, func(string) keyOptions {
+		return settings.keyOptions()
+	})
+}
+
+// Static functions
+
+func mergePeerKeys(into map[string]*hyperloglog.HyperLogLog, persistedKeys map[string]persistedKey, exactThreshold int) error {
+	for key, persisted := range persistedKeys {
+		peer := hyperloglog.NewEmptyHyperLogLog(exactThreshold, hyperloglog.DefaultPrecision)
+
+		if err := peer.UnmarshalBinary(persisted.HyperLogLog); err != nil {
+			return fmt.Errorf("failed to decode the peer HyperLogLog of key %s: %w", key, err)
+		}
+
+		merged, found := into[key]
+
+		if !found {
+			into[key] = peer
+
+			continue
+		}
+
+		if err := merged.Merge(peer); err != nil {
+			return fmt.Errorf("failed to merge the peer HyperLogLog of key %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/comfortablynumb/victor/internal/hyperloglog"
+	"github.com/spf13/viper"
+)
+
+func TestPeerStateIsBounded(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", 1_000_000)
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+	metricMap, _ := newMetricMaps(200_000, 2, 1)
+
+	send(b, metricMap)
+
+	state, err := b.PeerState()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxSize := 2*(1<<hyperloglog.DefaultPrecision) + 1024; len(state) > maxSize {
+		t.Fatalf("peer state of 2 promoted metric names is %d bytes, want %d at most", len(state), maxSize)
+	}
+}
+
+func TestRotateKeepsPeers(t *testing.T) {
+	local := newCardinalityTracker(2, 10)
+	peer := newCardinalityTracker(2, 10)
+
+	for i := 0; i < 100; i++ {
+		local.insertIfBelow("metric", "local:"+strconv.Itoa(i), 1000, defaultKeyOptions)
+		peer.insertIfBelow("metric", "peer:"+strconv.Itoa(i), 1000, defaultKeyOptions)
+	}
+
+	peerKey, _ := peer.get("metric")
+
+	if err := local.setPeers(map[string]*hyperloglog.HyperLogLog{"metric": peerKey.hyperLogLog}, func(string) keyOptions {
+		return defaultKeyOptions
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := local.rotate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	tracked, _ := local.get("metric")
+
+	if !tracked.peersContain(hyperloglog.Hash("peer:0")) || tracked.estimate() < 190 {
+		t.Fatalf("estimate is %d after a rotation, want the peer series to still count", tracked.estimate())
+	}
+}
+
+func TestPeerOnlyKeysHaveTheirPrecision(t *testing.T) {
+	backends := make([]*RateLimitedBackend, 2)
+
+	for i := range backends {
+		v := viper.New()
+
+		v.Set("rate-limit.limit-rules", []any{map[string]any{"pattern": "precise.*", "limit": 1000, "precision": 12}})
+
+		backends[i] = NewRateLimitedBackend(&nullBackend{}, v)
+	}
+
+	send(backends[0], newCounters("precise.metric", 10))
+
+	state, err := backends[0].PeerState()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backends[1].SetPeerStates([][]byte{state}); err != nil {
+		t.Fatal(err)
+	}
+
+	tracked, ok := backends[1].hyperLogLogByMetricName.get("precise.metric")
+
+	if !ok || tracked.hyperLogLog.Precision() != 12 {
+		t.Fatalf("metric name only known to the peer tracked %t, want it tracked with the precision of its rule", ok)
+	}
+}
@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Structs
+
+type persistedKey struct {
+	HyperLogLog []byte
+	SubWindows  [][]byte
+	Dropped     uint64
+	LastSeen    int64
+}
+
+// persistedState is the cardinality state of a backend as it's stored in its state file.
+type persistedState struct {
+	LastClearTime int64
+	MetricNames   map[string]persistedKey
+	EventKeys     map[string]persistedKey
+	TagKeys       map[string]persistedKey
+	Total         map[string]persistedKey
+}
+
+// runStatePersistence saves the cardinality state periodically, and once more when the context is done.
+func (b *RateLimitedBackend) runStatePersistence(ctx context.Context) {
+	ticker := time.NewTicker(b.stateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			b.saveStateAndLog()
+
+			return
+		case <-ticker.C:
+			b.saveStateAndLog()
+		}
+	}
+}
+
+func (b *RateLimitedBackend) saveStateAndLog() {
+	if err := b.saveState(); err != nil {
+		logrus.WithError(err).
+			WithField("backend", b.Name()).
+			WithField("file", b.stateFile).
+			Error("Failed to save the rate limit state")
+	}
+}
+
+// saveState writes the cardinality state to the state file. It writes a temporary file first and then renames it,
+// so a crash in the middle of a save never leaves a corrupted state file behind.
+func (b *RateLimitedBackend) saveState() error {
+	state := persistedState{
+		LastClearTime: atomic.LoadInt64(&b.lastClearTime),
+	}
+
+	var err error
+
+	if state.MetricNames, err = b.hyperLogLogByMetricName.snapshot(true); err != nil {
+		return err
+	}
+
+	if state.EventKeys, err = b.hyperLogLogByEventKey.snapshot(true); err != nil {
+		return err
+	}
+
+	if state.TagKeys, err = b.hyperLogLogByTagKey.snapshot(true); err != nil {
+		return err
+	}
+
+	if state.Total, err = b.hyperLogLogTotal.snapshot(true); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(b.stateFile), filepath.Base(b.stateFile)+".*.tmp")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+
+	if err := gob.NewEncoder(file).Encode(state); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), b.stateFile)
+}
+
+// loadState restores the cardinality state from the state file, if the window it was saved in is still current.
+// It returns whether the state was restored.
+func (b *RateLimitedBackend) loadState() (bool, error) {
+	file, err := os.Open(b.stateFile)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	var state persistedState
+
+	if err := gob.NewDecoder(file).Decode(&state); err != nil {
+		return false, fmt.Errorf("failed to decode the state file: %w", err)
+	}
+
+	if state.LastClearTime < time.Now().Add(-b.settings.Load().clearAfterDuration).Unix() {
+		return false, nil
+	}
+
+	restores := map[*cardinalityTracker]map[string]persistedKey{
+		b.hyperLogLogByMetricName: state.MetricNames,
+		b.hyperLogLogByEventKey:   state.EventKeys,
+		b.hyperLogLogByTagKey:     state.TagKeys,
+		b.hyperLogLogTotal:        state.Total,
+	}
+
+	for tracker, persistedKeys := range restores {
+		if err := tracker.restore(persistedKeys); err != nil {
+			// The trackers already restored are cleared too, so the new window starts with no state at all
+
+			for tracker := range restores {
+				tracker.clear()
+			}
+
+			return false, err
+		}
+	}
+
+	atomic.StoreInt64(&b.lastClearTime, state.LastClearTime)
+
+	return true, nil
+}
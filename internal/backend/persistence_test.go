@@ -0,0 +1,60 @@
+package backend
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestLoadStateFailureClearsEveryTracker(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "victor.state")
+
+	v := viper.New()
+
+	v.Set("rate-limit.state-file", stateFile)
+
+	saved := NewRateLimitedBackend(&nullBackend{}, v)
+	metricMap, _ := newMetricMaps(100, 10, 1)
+
+	send(saved, metricMap)
+
+	metricNames, err := saved.hyperLogLogByMetricName.snapshot(false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tag keys were saved with a sub-window, which the fixed window can't restore
+
+	state := persistedState{
+		LastClearTime: time.Now().Unix(),
+		MetricNames:   metricNames,
+		TagKeys:       map[string]persistedKey{"tag": {HyperLogLog: metricNames["bench.metric.0"].HyperLogLog, SubWindows: [][]byte{nil}}},
+	}
+
+	file, err := os.Create(stateFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gob.NewEncoder(file).Encode(state); err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+
+	if restored, err := b.loadState(); restored || err == nil {
+		t.Fatalf("state restored %t with error %v, want a failure", restored, err)
+	}
+
+	if size := b.hyperLogLogByMetricName.size(); size != 0 {
+		t.Fatalf("%d metric names left after a failed restore, want none", size)
+	}
+}
@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// Structs
+
+// priorityClass gives a priority to the series matching its metric name pattern and/or any of its tags. A tag
+// without a value matches the tag key with any value. Critical series bypass every limit, but still count toward the
+// total limit.
+type priorityClass struct {
+	namePattern `mapstructure:",squash"`
+
+	Name     string   `mapstructure:"name"`
+	Tags     []string `mapstructure:"tags"`
+	Priority int      `mapstructure:"priority"`
+	Critical bool     `mapstructure:"critical"`
+}
+
+func (c *priorityClass) matchTags(tags gostatsd.Tags) bool {
+	if len(c.Tags) == 0 {
+		return true
+	}
+
+	for _, classTag := range c.Tags {
+		for _, tag := range tags {
+			if tag == classTag || (!strings.Contains(classTag, tagKeyValueSplit) && strings.HasPrefix(tag, classTag+tagKeyValueSplit)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// priorityClassifier resolves the priority class of a series, where the first matching class wins. As evaluating
+// the patterns on every series would be expensive, the classes matching a metric name are cached by metric name, up to
+// maxCachedMetricNames, and only their tags are checked for every series.
+type priorityClassifier struct {
+	classes     []priorityClass
+	maxPriority int
+	classCache  map[string][]*priorityClass
+	mutex       *sync.RWMutex
+}
+
+// classify returns the priority class of a series, or nil if it has none.
+func (c *priorityClassifier) classify(metricName string, tags gostatsd.Tags) *priorityClass {
+	if len(c.classes) == 0 {
+		return nil
+	}
+
+	for _, class := range c.classesFor(metricName) {
+		if class.matchTags(tags) {
+			return class
+		}
+	}
+
+	return nil
+}
+
+func (c *priorityClassifier) classesFor(metricName string) []*priorityClass {
+	c.mutex.RLock()
+
+	classes, found := c.classCache[metricName]
+
+	c.mutex.RUnlock()
+
+	if found {
+		return classes
+	}
+
+	for i := range c.classes {
+		if c.classes[i].Pattern == "" || c.classes[i].match(metricName) {
+			classes = append(classes, &c.classes[i])
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.classCache) < maxCachedMetricNames {
+		c.classCache[metricName] = classes
+	}
+
+	return classes
+}
+
+// clearCache clears the resolved classes, so the cache only holds the metric names seen in the current window.
+func (c *priorityClassifier) clearCache() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.classCache = make(map[string][]*priorityClass)
+}
+
+// Static functions
+
+func newPriorityClassifier(classes []priorityClass) (*priorityClassifier, error) {
+	maxPriority := 0
+
+	for i := range classes {
+		class := &classes[i]
+
+		if class.Name == "" {
+			return nil, fmt.Errorf("priority class has no name. Class: %#v", class)
+		}
+
+		if class.Pattern == "" && len(class.Tags) == 0 {
+			return nil, fmt.Errorf("priority class has no pattern nor tags. Class: %#v", class)
+		}
+
+		if class.Priority < 0 {
+			return nil, fmt.Errorf("priority class has a negative priority. Class: %#v", class)
+		}
+
+		if class.Pattern != "" {
+			if err := class.compile(); err != nil {
+				return nil, fmt.Errorf("priority class is invalid. Class: %#v - Error: %w", class, err)
+			}
+		}
+
+		if !class.Critical {
+			maxPriority = max(maxPriority, class.Priority)
+		}
+	}
+
+	return &priorityClassifier{
+		classes:     classes,
+		maxPriority: maxPriority,
+		classCache:  make(map[string][]*priorityClass),
+		mutex:       &sync.RWMutex{},
+	}, nil
+}
@@ -1,209 +1,499 @@
-package backend
-
-import (
-	"context"
-	"sync"
-	"sync/atomic"
-	"time"
-
-	"github.com/atlassian/gostatsd"
-	"github.com/comfortablynumb/victor/internal/config"
-	"github.com/comfortablynumb/victor/internal/hyperloglog"
-	"github.com/comfortablynumb/victor/internal/util"
-	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
-)
-
-// Structs
-
-type RateLimitedBackend struct {
-	lastClearTime int64
-
-	backend                 gostatsd.Backend
-	backendRunner           gostatsd.Runner
-	backendMetricsRunner    gostatsd.MetricsRunner
-	hyperLogLogByMetricName map[string]*hyperloglog.HyperLogLog
-	mutex                   *sync.RWMutex
-	limit                   uint64
-	clearAfterDuration      time.Duration
-	limitByMetricName       map[string]int
-}
-
-func (b *RateLimitedBackend) SendMetricsAsync(ctx context.Context, metricMap *gostatsd.MetricMap, callback gostatsd.SendCallback) {
-	if atomic.LoadInt64(&b.lastClearTime) < time.Now().Add(-b.clearAfterDuration).Unix() {
-		b.clearHyperLogLogs()
-	}
-
-	b.rateLimit(metricMap)
-
-	b.backend.SendMetricsAsync(ctx, metricMap, callback)
-}
-
-func (b *RateLimitedBackend) SendEvent(ctx context.Context, event *gostatsd.Event) error {
-	return b.backend.SendEvent(ctx, event)
-}
-
-func (b *RateLimitedBackend) Run(ctx context.Context) {
-	if b.backendRunner != nil {
-		b.backendRunner.Run(ctx)
-	}
-}
-
-func (b *RateLimitedBackend) RunMetricsContext(ctx context.Context) {
-	if b.backendMetricsRunner != nil {
-		b.backendMetricsRunner.RunMetricsContext(ctx)
-	}
-}
-
-func (b *RateLimitedBackend) Name() string {
-	return b.backend.Name()
-}
-
-func (b *RateLimitedBackend) clearHyperLogLogs() {
-	atomic.StoreInt64(&b.lastClearTime, time.Now().Unix())
-
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	b.hyperLogLogByMetricName = make(map[string]*hyperloglog.HyperLogLog)
-}
-
-func (b *RateLimitedBackend) rateLimit(metricMap *gostatsd.MetricMap) {
-	// Check if we need to drop some metrics
-
-	// :: Counters
-
-	metricMap.Counters.Each(func(metricName string, tagsKey string, c gostatsd.Counter) {
-		limit := b.limit
-
-		if _, ok := b.limitByMetricName[metricName]; ok {
-			limit = uint64(b.limitByMetricName[metricName])
-		}
-
-		if _, valid := b.estimate(metricName, tagsKey, limit); !valid {
-			metricMap.Counters.Delete(metricName)
-		}
-	})
-
-	// :: Gauges
-
-	metricMap.Gauges.Each(func(metricName string, tagsKey string, g gostatsd.Gauge) {
-		limit := b.limit
-
-		if _, ok := b.limitByMetricName[metricName]; ok {
-			limit = uint64(b.limitByMetricName[metricName])
-		}
-
-		if _, valid := b.estimate(metricName, tagsKey, limit); !valid {
-			metricMap.Gauges.Delete(metricName)
-		}
-	})
-
-	// :: Timers
-
-	metricMap.Timers.Each(func(metricName string, tagsKey string, t gostatsd.Timer) {
-		limit := b.limit
-
-		if _, ok := b.limitByMetricName[metricName]; ok {
-			limit = uint64(b.limitByMetricName[metricName])
-		}
-
-		if _, valid := b.estimate(metricName, tagsKey, limit); !valid {
-			metricMap.Timers.Delete(metricName)
-		}
-	})
-}
-
-func (b *RateLimitedBackend) addMetricTags(metricName string, tags string) {
-	b.mutex.Lock()
-
-	defer b.mutex.Unlock()
-
-	b.hyperLogLogByMetricName[metricName].Insert(tags)
-}
-
-func (b *RateLimitedBackend) estimate(metricName string, tags string, limit uint64) (uint64, bool) {
-	b.mutex.RLock()
-
-	val, found := b.hyperLogLogByMetricName[metricName]
-
-	b.mutex.RUnlock()
-
-	if !found {
-		b.addNewMetric(metricName, tags)
-
-		return 0, true
-	}
-
-	res := val.Estimate()
-
-	if res < limit {
-		val.Insert(tags)
-
-		return res, true
-	}
-
-	return res, false
-}
-
-func (b *RateLimitedBackend) addNewMetric(metricName string, tags string) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	hyperLogLog := hyperloglog.NewHyperLogLog(tags)
-
-	b.hyperLogLogByMetricName[metricName] = hyperLogLog
-}
-
-// Static functions
-
-func NewRateLimitedBackend(
-	backendToRateLimit gostatsd.Backend,
-	v *viper.Viper,
-) *RateLimitedBackend {
-	// Rate limits configs
-
-	v = util.GetSubViper(v, config.ParamRateLimit)
-
-	v.SetDefault(config.ParamDefaultLimit, config.DefaultLimit)
-	v.SetDefault(config.ParamClearAfterDuration, config.DefaultClearAfterDuration)
-	v.SetDefault(config.ParamLimitByMetricName, make(map[string]int))
-
-	limit := v.GetUint64(config.ParamDefaultLimit)
-	clearAfterDuration := v.GetDuration(config.ParamClearAfterDuration)
-	limitByMetricName, err := util.ConvertMap[string, int](v.GetStringMap(config.ParamLimitByMetricName))
-
-	if err != nil {
-		logrus.WithError(err).Fatal("Failed to convert limit-by-tag to map[string]int")
-	}
-
-	hyperLogLogByMetricName := make(map[string]*hyperloglog.HyperLogLog, 100)
-
-	var backendRunner gostatsd.Runner
-	var backendMetricsRunner gostatsd.MetricsRunner
-
-	if castedBackendRunner, ok := backendToRateLimit.(gostatsd.Runner); ok {
-		backendRunner = castedBackendRunner
-	}
-
-	if castedBackendMetricsRunner, ok := backendToRateLimit.(gostatsd.MetricsRunner); ok {
-		backendMetricsRunner = castedBackendMetricsRunner
-	}
-
-	logrus.WithField("backend", backendToRateLimit.Name()).
-		WithField(config.ParamDefaultLimit, limit).
-		WithField(config.ParamClearAfterDuration, clearAfterDuration).
-		Info("Rate limit is enabled for backend")
-
-	return &RateLimitedBackend{
-		backend:                 backendToRateLimit,
-		backendRunner:           backendRunner,
-		backendMetricsRunner:    backendMetricsRunner,
-		hyperLogLogByMetricName: hyperLogLogByMetricName,
-		mutex:                   &sync.RWMutex{},
-		limit:                   limit,
-		clearAfterDuration:      clearAfterDuration,
-		limitByMetricName:       limitByMetricName,
-		lastClearTime:           time.Now().Unix(),
-	}
-}
+package backend
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/comfortablynumb/victor/internal/util"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Structs
+
+type RateLimitedBackend struct {
+	lastClearTime int64
+
+	backend                 gostatsd.Backend
+	backendRunner           gostatsd.Runner
+	backendMetricsRunner    gostatsd.MetricsRunner
+	hyperLogLogByMetricName *cardinalityTracker
+	hyperLogLogByEventKey   *cardinalityTracker
+	hyperLogLogByTagKey     *cardinalityTracker
+	hyperLogLogTotal        *cardinalityTracker
+	settings                atomic.Pointer[rateLimitSettings]
+	stats                   *rateLimitStats
+	stateFile               string
+	stateSaveInterval       time.Duration
+	subWindows              int
+	exactThreshold          int
+	offenders               *topOffenders
+	offendersLogInterval    time.Duration
+	tagValuesRewritten      func(metricName string, tagsKey string, newTagsKey string)
+}
+
+func (b *RateLimitedBackend) SendMetricsAsync(ctx context.Context, metricMap *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	// The settings are loaded once, so a reload does not change them in the middle of a flush
+
+	settings := b.settings.Load()
+
+	// The same metric map is sent to every backend, so it's copied before it's modified
+
+	if settings.mode != config.ModeShadow {
+		metricMap = copyMetricMap(metricMap)
+	}
+
+	b.rateLimit(settings, metricMap)
+
+	b.backend.SendMetricsAsync(ctx, metricMap, callback)
+}
+
+func (b *RateLimitedBackend) SendEvent(ctx context.Context, event *gostatsd.Event) error {
+	settings := b.settings.Load()
+
+	eventKey := event.AggregationKey
+
+	if eventKey == "" {
+		eventKey = event.Title
+	}
+
+	b.hyperLogLogByEventKey.tick(time.Now().Unix())
+
+	if admitted, _ := b.hyperLogLogByEventKey.insertIfBelow(eventKey, gostatsd.FormatTagsKey(event.Source, event.Tags), settings.eventLimit, settings.eventKeyOptions()); !admitted {
+		b.stats.events.add(0, 1)
+
+		if settings.mode == config.ModeShadow {
+			logrus.WithField("backend", b.Name()).
+				WithField("event", eventKey).
+				Debug("Event would be dropped by rate limit")
+
+			return b.backend.SendEvent(ctx, event)
+		}
+
+		logrus.WithField("backend", b.Name()).
+			WithField("event", eventKey).
+			Debug("Event dropped by rate limit")
+
+		return nil
+	}
+
+	b.stats.events.add(1, 0)
+
+	return b.backend.SendEvent(ctx, event)
+}
+
+func (b *RateLimitedBackend) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	defer wg.Wait()
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		b.runWindowScheduler(ctx)
+	}()
+
+	if b.stateFile != "" {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			b.runStatePersistence(ctx)
+		}()
+	}
+
+	if b.offenders.enabled() && b.offendersLogInterval > 0 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			b.runOffendersLog(ctx)
+		}()
+	}
+
+	if b.backendRunner != nil {
+		b.backendRunner.Run(ctx)
+	}
+}
+
+func (b *RateLimitedBackend) RunMetricsContext(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	defer wg.Wait()
+
+	if b.backendMetricsRunner != nil {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			b.backendMetricsRunner.RunMetricsContext(ctx)
+		}()
+	}
+
+	b.runMetrics(ctx, stats.FromContext(ctx))
+}
+
+func (b *RateLimitedBackend) Name() string {
+	return b.backend.Name()
+}
+
+// Reload swaps the settings of the backend for the ones in the given viper, keeping the current cardinality state.
+// If the new settings are invalid, an error is returned and the current settings stay active.
+func (b *RateLimitedBackend) Reload(v *viper.Viper) error {
+	settings, err := newRateLimitSettings(util.GetSubViper(v, config.ParamRateLimit), b.hyperLogLogByTagKey)
+
+	if err != nil {
+		return err
+	}
+
+	b.settings.Store(settings)
+
+	b.logSettings("Rate limit configuration reloaded for backend")
+
+	return nil
+}
+
+// OnTagValuesRewritten sets a function called with every series whose tags the tag value limits rewrite or strip,
+// with its tags key before and after. It must be set before any metric is sent.
+func (b *RateLimitedBackend) OnTagValuesRewritten(f func(metricName string, tagsKey string, newTagsKey string)) {
+	b.tagValuesRewritten = f
+}
+
+func (b *RateLimitedBackend) logSettings(message string) {
+	settings := b.settings.Load()
+
+	logrus.WithField("backend", b.Name()).
+		WithField(config.ParamDefaultLimit, settings.limits.defaultLimit).
+		WithField(config.ParamEventLimit, settings.eventLimit).
+		WithField(config.ParamClearAfterDuration, settings.clearAfterDuration).
+		WithField(config.ParamTotalLimit, settings.totalBudget.limit).
+		WithField(config.ParamMode, settings.mode).
+		WithField(config.ParamSubWindows, b.subWindows).
+		WithField(config.ParamExactThreshold, b.exactThreshold).
+		WithField(config.ParamPrecision, settings.precision).
+		WithField(config.ParamMaxMetricNames, settings.maxMetricNames).
+		WithField(config.ParamTopOffenders, b.offenders.n).
+		WithField(config.ParamAlignWindows, settings.windowAlignment != nil).
+		Info(message)
+}
+
+// maybeClearHyperLogLogs clears the window if it ended, or slides it by the sub-windows that ended with a sliding
+// window. Only the caller that moves lastClearTime forward does it, so an admin reset can't race with the scheduler.
+func (b *RateLimitedBackend) maybeClearHyperLogLogs(now time.Time) bool {
+	settings := b.settings.Load()
+	period := b.windowPeriod(settings)
+	lastClearTime := atomic.LoadInt64(&b.lastClearTime)
+	windowStart := settings.windowStart(now, lastClearTime, period)
+
+	if windowStart <= lastClearTime || !atomic.CompareAndSwapInt64(&b.lastClearTime, lastClearTime, windowStart) {
+		return false
+	}
+
+	if b.subWindows == 0 {
+		b.clearTrackers()
+
+		return true
+	}
+
+	// After an admin reset, lastClearTime is not aligned to a boundary, so the first rotation rounds up
+
+	periodSeconds := max(int64(period/time.Second), 1)
+	rotations := (windowStart - lastClearTime + periodSeconds - 1) / periodSeconds
+
+	b.rotateHyperLogLogs(int(min(rotations, int64(b.subWindows))))
+
+	return true
+}
+
+func (b *RateLimitedBackend) rotateHyperLogLogs(rotations int) {
+	b.stats.windowResets.Add(1)
+
+	for _, tracker := range []*cardinalityTracker{b.hyperLogLogByMetricName, b.hyperLogLogByEventKey, b.hyperLogLogByTagKey, b.hyperLogLogTotal} {
+		if err := tracker.rotate(rotations); err != nil {
+			logrus.WithError(err).
+				WithField("backend", b.Name()).
+				Error("Failed to rotate the rate limit window. Clearing it")
+
+			tracker.clear()
+		}
+	}
+
+	// The counts of the top offenders fade by the share of the window that slid out of it
+
+	b.offenders.decay(float64(max(b.subWindows-rotations, 0)) / float64(b.subWindows))
+	b.settings.Load().clearCaches()
+}
+
+func (b *RateLimitedBackend) clearHyperLogLogs(now time.Time) {
+	atomic.StoreInt64(&b.lastClearTime, now.Unix())
+
+	b.clearTrackers()
+}
+
+func (b *RateLimitedBackend) clearTrackers() {
+	b.stats.windowResets.Add(1)
+
+	b.hyperLogLogByMetricName.clear()
+	b.hyperLogLogByEventKey.clear()
+	b.hyperLogLogByTagKey.clear()
+	b.hyperLogLogTotal.clear()
+	b.offenders.clear()
+	b.settings.Load().clearCaches()
+}
+
+func (b *RateLimitedBackend) rateLimit(settings *rateLimitSettings, metricMap *gostatsd.MetricMap) {
+	b.hyperLogLogByMetricName.tick(time.Now().Unix())
+
+	// Rewrite or strip the tag values over their limits first, so the resulting series are the ones limited. In shadow
+	// mode, they are rewritten in a copy, so the series estimated are the same as in the other modes, but the ones
+	// sent are left untouched.
+
+	shadow := settings.mode == config.ModeShadow
+
+	if settings.tagValueLimiter.enabled() {
+		if shadow {
+			metricMap = copyMetricMap(metricMap)
+		}
+
+		rewritten := slices.Concat(
+			limitTagValues(metricMap.Counters, settings.tagValueLimiter, counterAccessor()),
+			limitTagValues(metricMap.Gauges, settings.tagValueLimiter, gaugeAccessor(settings.overflowGaugeMerge)),
+			limitTagValues(metricMap.Timers, settings.tagValueLimiter, timerAccessor()),
+			limitTagValues(metricMap.Sets, settings.tagValueLimiter, setAccessor()),
+		)
+
+		if shadow {
+			b.logShadowedTagValues(rewritten)
+		}
+
+		if b.tagValuesRewritten != nil {
+			for _, r := range rewritten {
+				b.tagValuesRewritten(r.metricName, r.tagsKey, r.newTagsKey)
+			}
+		}
+	}
+
+	// Check if we need to drop some metrics. Only the series over the limit are rejected, so the ones already
+	// admitted in the current window keep flowing.
+
+	rejectedCounters := make(rejectedSeries)
+	rejectedGauges := make(rejectedSeries)
+	rejectedTimers := make(rejectedSeries)
+	rejectedSets := make(rejectedSeries)
+	offenders := b.offenders.newBatch()
+
+	defer b.offenders.addBatch(offenders)
+
+	// :: Counters
+
+	metricMap.Counters.Each(func(metricName string, tagsKey string, c gostatsd.Counter) {
+		if !b.admit(settings, offenders, metricName, tagsKey, c.Tags) {
+			rejectedCounters.add(metricName, tagsKey)
+		}
+	})
+
+	b.stats.counters.add(seriesCount(metricMap.Counters)-rejectedCounters.len(), rejectedCounters.len())
+
+	// :: Gauges
+
+	metricMap.Gauges.Each(func(metricName string, tagsKey string, g gostatsd.Gauge) {
+		if !b.admit(settings, offenders, metricName, tagsKey, g.Tags) {
+			rejectedGauges.add(metricName, tagsKey)
+		}
+	})
+
+	b.stats.gauges.add(seriesCount(metricMap.Gauges)-rejectedGauges.len(), rejectedGauges.len())
+
+	// :: Timers
+
+	metricMap.Timers.Each(func(metricName string, tagsKey string, t gostatsd.Timer) {
+		if !b.admit(settings, offenders, metricName, tagsKey, t.Tags) {
+			rejectedTimers.add(metricName, tagsKey)
+		}
+	})
+
+	b.stats.timers.add(seriesCount(metricMap.Timers)-rejectedTimers.len(), rejectedTimers.len())
+
+	// :: Sets
+
+	metricMap.Sets.Each(func(metricName string, tagsKey string, s gostatsd.Set) {
+		if !b.admit(settings, offenders, metricName, tagsKey, s.Tags) {
+			rejectedSets.add(metricName, tagsKey)
+		}
+	})
+
+	b.stats.sets.add(seriesCount(metricMap.Sets)-rejectedSets.len(), rejectedSets.len())
+
+	// Now apply the configured mode to the rejected series
+
+	if shadow {
+		b.logShadowedSeries(map[string]rejectedSeries{
+			MetricTypeCounter: rejectedCounters,
+			MetricTypeGauge:   rejectedGauges,
+			MetricTypeTimer:   rejectedTimers,
+			MetricTypeSet:     rejectedSets,
+		})
+
+		return
+	}
+
+	if settings.mode == config.ModeOverflow {
+		overflowRejectedSeries(b, settings, metricMap.Counters, rejectedCounters, counterAccessor())
+		overflowRejectedSeries(b, settings, metricMap.Gauges, rejectedGauges, gaugeAccessor(settings.overflowGaugeMerge))
+		overflowRejectedSeries(b, settings, metricMap.Timers, rejectedTimers, timerAccessor())
+		overflowRejectedSeries(b, settings, metricMap.Sets, rejectedSets, setAccessor())
+
+		return
+	}
+
+	b.stats.counters.droppedValues.Add(countRejectedValues(metricMap.Counters, rejectedCounters, counterAccessor()))
+	b.stats.gauges.droppedValues.Add(countRejectedValues(metricMap.Gauges, rejectedGauges, gaugeAccessor(settings.overflowGaugeMerge)))
+	b.stats.timers.droppedValues.Add(countRejectedValues(metricMap.Timers, rejectedTimers, timerAccessor()))
+	b.stats.sets.droppedValues.Add(countRejectedValues(metricMap.Sets, rejectedSets, setAccessor()))
+
+	dropRejectedSeries(metricMap.Counters, rejectedCounters)
+	dropRejectedSeries(metricMap.Gauges, rejectedGauges)
+	dropRejectedSeries(metricMap.Timers, rejectedTimers)
+	dropRejectedSeries(metricMap.Sets, rejectedSets)
+}
+
+// Static functions
+
+// dropSeries removes a single series from the metrics, and the metric name itself once it has no series left.
+func dropSeries(metrics gostatsd.AggregatedMetrics, metricName string, tagsKey string) {
+	metrics.DeleteChild(metricName, tagsKey)
+
+	if !metrics.HasChildren(metricName) {
+		metrics.Delete(metricName)
+	}
+}
+
+func NewRateLimitedBackend(
+	backendToRateLimit gostatsd.Backend,
+	v *viper.Viper,
+) *RateLimitedBackend {
+	// Rate limits configs
+
+	v = util.GetSubViper(v, config.ParamRateLimit)
+
+	v.SetDefault(config.ParamStateSaveInterval, config.DefaultStateSaveInterval)
+	v.SetDefault(config.ParamWindow, config.DefaultWindow)
+	v.SetDefault(config.ParamSubWindows, config.DefaultSubWindows)
+	v.SetDefault(config.ParamExactThreshold, config.DefaultExactThreshold)
+	v.SetDefault(config.ParamTopOffendersLog, config.DefaultTopOffendersLog)
+
+	subWindows := 0
+
+	switch window := v.GetString(config.ParamWindow); window {
+	case config.WindowFixed:
+	case config.WindowSliding:
+		subWindows = v.GetInt(config.ParamSubWindows)
+
+		if subWindows <= 0 {
+			logrus.WithField("backend", backendToRateLimit.Name()).
+				WithField(config.ParamSubWindows, subWindows).
+				Fatal("Invalid rate limit sub-windows")
+		}
+	default:
+		logrus.WithField("backend", backendToRateLimit.Name()).
+			WithField(config.ParamWindow, window).
+			Fatal("Invalid rate limit window")
+	}
+
+	exactThreshold := v.GetInt(config.ParamExactThreshold)
+
+	if exactThreshold < 0 {
+		logrus.WithField("backend", backendToRateLimit.Name()).
+			WithField(config.ParamExactThreshold, exactThreshold).
+			Fatal("Invalid rate limit exact threshold")
+	}
+
+	topOffenders := v.GetInt(config.ParamTopOffenders)
+
+	if topOffenders < 0 {
+		logrus.WithField("backend", backendToRateLimit.Name()).
+			WithField(config.ParamTopOffenders, topOffenders).
+			Fatal("Invalid rate limit top offenders")
+	}
+
+	hyperLogLogByTagKey := newCardinalityTracker(subWindows, exactThreshold)
+	settings, err := newRateLimitSettings(v, hyperLogLogByTagKey)
+
+	if err != nil {
+		logrus.WithError(err).
+			WithField("backend", backendToRateLimit.Name()).
+			Fatal("Invalid rate limit configuration")
+	}
+
+	var backendRunner gostatsd.Runner
+	var backendMetricsRunner gostatsd.MetricsRunner
+
+	if castedBackendRunner, ok := backendToRateLimit.(gostatsd.Runner); ok {
+		backendRunner = castedBackendRunner
+	}
+
+	if castedBackendMetricsRunner, ok := backendToRateLimit.(gostatsd.MetricsRunner); ok {
+		backendMetricsRunner = castedBackendMetricsRunner
+	}
+
+	b := &RateLimitedBackend{
+		backend:                 backendToRateLimit,
+		backendRunner:           backendRunner,
+		backendMetricsRunner:    backendMetricsRunner,
+		hyperLogLogByMetricName: newCardinalityTracker(subWindows, exactThreshold),
+		hyperLogLogByEventKey:   newCardinalityTracker(subWindows, exactThreshold),
+		hyperLogLogByTagKey:     hyperLogLogByTagKey,
+		hyperLogLogTotal:        newCardinalityTracker(subWindows, exactThreshold),
+		stats:                   &rateLimitStats{},
+		lastClearTime:           time.Now().Unix(),
+		stateFile:               v.GetString(config.ParamStateFile),
+		stateSaveInterval:       v.GetDuration(config.ParamStateSaveInterval),
+		subWindows:              subWindows,
+		exactThreshold:          exactThreshold,
+		offenders:               newTopOffenders(topOffenders),
+		offendersLogInterval:    v.GetDuration(config.ParamTopOffendersLog),
+	}
+
+	b.settings.Store(settings)
+
+	if settings.windowAlignment != nil {
+		b.lastClearTime = settings.windowStart(time.Now(), b.lastClearTime, b.windowPeriod(settings))
+	}
+
+	b.logSettings("Rate limit is enabled for backend")
+
+	if b.stateFile != "" {
+		if b.stateSaveInterval <= 0 {
+			logrus.WithField("backend", b.Name()).
+				WithField(config.ParamStateSaveInterval, b.stateSaveInterval).
+				Fatal("Invalid rate limit state save interval")
+		}
+
+		restored, err := b.loadState()
+
+		if err != nil {
+			logrus.WithError(err).
+				WithField("backend", b.Name()).
+				WithField("file", b.stateFile).
+				Error("Failed to restore the rate limit state. Starting a new window")
+		}
+
+		logrus.WithField("backend", b.Name()).
+			WithField("file", b.stateFile).
+			WithField("restored", restored).
+			Info("Rate limit state persistence is enabled for backend")
+	}
+
+	return b
+}
@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/comfortablynumb/victor/internal/util"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Structs
+
+// ConfigReloader reloads the rate limit configuration of the backends when the config file changes, or when the
+// process receives a SIGHUP. Both are handled by the same goroutine, and every reload reads the config file into a
+// new viper, as vipers are not safe for concurrent use.
+type ConfigReloader struct {
+	configFile string
+	backends   []*RateLimitedBackend
+}
+
+func (r *ConfigReloader) Run(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	var changes chan fsnotify.Event
+	var watchErrors chan error
+
+	// The directory is watched instead of the file, so the file is still watched after an editor replaces it
+
+	watcher, err := fsnotify.NewWatcher()
+
+	if err == nil {
+		defer watcher.Close()
+
+		err = watcher.Add(filepath.Dir(r.configFile))
+		changes, watchErrors = watcher.Events, watcher.Errors
+	}
+
+	if err != nil {
+		logrus.WithError(err).
+			WithField("file", r.configFile).
+			Error("Failed to watch the config file. It's only reloaded on SIGHUP")
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			r.reload("SIGHUP")
+		case e := <-changes:
+			if filepath.Clean(e.Name) == r.configFile && e.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				r.reload("config file " + e.Op.String())
+			}
+		case err := <-watchErrors:
+			logrus.WithError(err).
+				WithField("file", r.configFile).
+				Error("Failed to watch the config file")
+		}
+	}
+}
+
+func (r *ConfigReloader) reload(reason string) {
+	v := viper.New()
+
+	util.InitViper(v, "")
+	v.SetConfigFile(r.configFile)
+
+	if err := v.ReadInConfig(); err != nil {
+		logrus.WithError(err).
+			WithField("reason", reason).
+			Error("Failed to read the config file. Keeping the current configuration")
+
+		return
+	}
+
+	for _, b := range r.backends {
+		if err := b.Reload(util.GetSubViper(v, b.Name())); err != nil {
+			logrus.WithError(err).
+				WithField("backend", b.Name()).
+				WithField("reason", reason).
+				Error("Invalid rate limit configuration. Keeping the current one")
+		}
+	}
+}
+
+// Static functions
+
+func NewConfigReloader(v *viper.Viper, backends []*RateLimitedBackend) *ConfigReloader {
+	return &ConfigReloader{
+		configFile: filepath.Clean(v.ConfigFileUsed()),
+		backends:   backends,
+	}
+}
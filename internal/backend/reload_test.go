@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfigReloader(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+
+	writeConfig(t, configFile, 10)
+
+	v := viper.New()
+
+	v.SetConfigFile(configFile)
+
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewRateLimitedBackend(&nullBackend{}, v.Sub("null"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	go func() {
+		defer close(done)
+
+		NewConfigReloader(v, []*RateLimitedBackend{b}).Run(ctx)
+	}()
+
+	// The file change and the SIGHUP that usually follows it both reload the config, one after the other
+
+	time.Sleep(100 * time.Millisecond)
+	writeConfig(t, configFile, 20)
+	waitForDefaultLimit(t, b, 20)
+
+	writeConfig(t, configFile, 30)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForDefaultLimit(t, b, 30)
+}
+
+func writeConfig(t *testing.T, configFile string, defaultLimit int) {
+	t.Helper()
+
+	config := "'null':\n  rate-limit:\n    enabled: true\n    default-limit: " + strconv.Itoa(defaultLimit) + "\n"
+
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForDefaultLimit(t *testing.T, b *RateLimitedBackend, defaultLimit uint64) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if b.settings.Load().limits.defaultLimit == defaultLimit {
+			return
+		}
+	}
+
+	t.Fatalf("default limit is %d, want %d after the reload", b.settings.Load().limits.defaultLimit, defaultLimit)
+}
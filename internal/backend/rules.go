@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sync"
+
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/comfortablynumb/victor/internal/hyperloglog"
+)
+
+// Constants
+
+// maxCachedMetricNames is the maximum number of metric names whose resolved limit or priority classes are cached in a
+// window. The rest are resolved on every series, so a flood of distinct metric names can't grow the caches unbounded.
+const maxCachedMetricNames = 100_000
+
+// Structs
+
+// namePattern matches metric names with a glob (the default) or a regex.
+type namePattern struct {
+	Pattern string `mapstructure:"pattern"`
+	Type    string `mapstructure:"type"`
+
+	regex *regexp.Regexp
+}
+
+// compile validates the pattern, and compiles it if it's a regex.
+func (p *namePattern) compile() error {
+	switch p.Type {
+	case "", config.RuleTypeGlob:
+		p.Type = config.RuleTypeGlob
+
+		if _, err := path.Match(p.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern: %w", err)
+		}
+	case config.RuleTypeRegex:
+		regex, err := regexp.Compile(p.Pattern)
+
+		if err != nil {
+			return fmt.Errorf("invalid regex pattern: %w", err)
+		}
+
+		p.regex = regex
+	default:
+		return fmt.Errorf("invalid type: %s", p.Type)
+	}
+
+	return nil
+}
+
+func (p *namePattern) match(metricName string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(metricName)
+	}
+
+	// The pattern was validated when it was compiled
+
+	matched, _ := path.Match(p.Pattern, metricName)
+
+	return matched
+}
+
+type limitRule struct {
+	namePattern `mapstructure:",squash"`
+
+	Limit     uint64 `mapstructure:"limit"`
+	Priority  int    `mapstructure:"priority"`
+	Precision uint8  `mapstructure:"precision"`
+}
+
+// resolvedLimit is the limit of a metric name, its priority when the total limit runs short, and the precision of its
+// HyperLogLogs, where zero means the one of the backend.
+type resolvedLimit struct {
+	limit     uint64
+	priority  int
+	precision uint8
+}
+
+// limitResolver resolves the limit of a metric name. Exact limits by metric name are checked first, then the rules
+// in order, where the first match wins, and then the default limit. As evaluating the rules on every series would be
+// expensive, the resolved limits are cached by metric name, up to maxCachedMetricNames.
+type limitResolver struct {
+	defaultLimit      uint64
+	limitByMetricName map[string]int
+	rules             []limitRule
+	maxPriority       int
+	limitCache        map[string]resolvedLimit
+	mutex             *sync.RWMutex
+}
+
+func (r *limitResolver) limitFor(metricName string) uint64 {
+	return r.resolve(metricName).limit
+}
+
+// resolve returns the limit and priority of a metric name. Exact limits by metric name have the default priority.
+func (r *limitResolver) resolve(metricName string) resolvedLimit {
+	if limit, ok := r.limitByMetricName[metricName]; ok {
+		return resolvedLimit{limit: uint64(limit)}
+	}
+
+	if len(r.rules) == 0 {
+		return resolvedLimit{limit: r.defaultLimit}
+	}
+
+	r.mutex.RLock()
+
+	limit, found := r.limitCache[metricName]
+
+	r.mutex.RUnlock()
+
+	if found {
+		return limit
+	}
+
+	limit = resolvedLimit{limit: r.defaultLimit}
+
+	for i := range r.rules {
+		if r.rules[i].match(metricName) {
+			limit = resolvedLimit{limit: r.rules[i].Limit, priority: r.rules[i].Priority, precision: r.rules[i].Precision}
+
+			break
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.limitCache) < maxCachedMetricNames {
+		r.limitCache[metricName] = limit
+	}
+
+	return limit
+}
+
+// clearCache clears the resolved limits, so the cache only holds the metric names seen in the current window.
+func (r *limitResolver) clearCache() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.limitCache = make(map[string]resolvedLimit)
+}
+
+// Static functions
+
+func newLimitResolver(defaultLimit uint64, limitByMetricName map[string]int, rules []limitRule) (*limitResolver, error) {
+	maxPriority := 0
+
+	for i := range rules {
+		rule := &rules[i]
+
+		if rule.Priority < 0 {
+			return nil, fmt.Errorf("limit rule has a negative priority. Rule: %#v", rule)
+		}
+
+		maxPriority = max(maxPriority, rule.Priority)
+
+		if rule.Precision != 0 && (rule.Precision < hyperloglog.MinPrecision || rule.Precision > hyperloglog.MaxPrecision) {
+			return nil, fmt.Errorf("limit rule has an invalid precision. Rule: %#v", rule)
+		}
+
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("limit rule is invalid. Rule: %#v - Error: %w", rule, err)
+		}
+	}
+
+	return &limitResolver{
+		defaultLimit:      defaultLimit,
+		limitByMetricName: limitByMetricName,
+		rules:             rules,
+		maxPriority:       maxPriority,
+		limitCache:        make(map[string]resolvedLimit),
+		mutex:             &sync.RWMutex{},
+	}, nil
+}
@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/comfortablynumb/victor/internal/config"
+)
+
+func TestLimitCacheIsBounded(t *testing.T) {
+	limits, err := newLimitResolver(10, nil, []limitRule{{namePattern: namePattern{Pattern: "api.*"}, Limit: 100}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxCachedMetricNames+10; i++ {
+		limits.resolve("metric." + strconv.Itoa(i))
+	}
+
+	if len(limits.limitCache) != maxCachedMetricNames {
+		t.Fatalf("%d limits cached, want %d", len(limits.limitCache), maxCachedMetricNames)
+	}
+
+	if limit := limits.limitFor("api.uncached"); limit != 100 {
+		t.Fatalf("limit of a metric name past the cache is %d, want 100", limit)
+	}
+}
+
+func TestLimitRules(t *testing.T) {
+	limits, err := newLimitResolver(10, map[string]int{"api.exact": 5}, []limitRule{
+		{namePattern: namePattern{Pattern: "api.*"}, Limit: 100, Priority: 1},
+		{namePattern: namePattern{Pattern: "api.cache.*"}, Limit: 200},
+		{namePattern: namePattern{Pattern: `^db\.[a-z]+\.[0-9]+$`, Type: config.RuleTypeRegex}, Limit: 300, Precision: 12},
+		{namePattern: namePattern{Pattern: "db.*", Type: config.RuleTypeGlob}, Limit: 400},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		metricName string
+		want       resolvedLimit
+	}{
+		// Exact limits by metric name win over the rules, with the default priority
+		{"api.exact", resolvedLimit{limit: 5}},
+		// The first matching rule wins, even if a later one is more specific
+		{"api.cache.hits", resolvedLimit{limit: 100, priority: 1}},
+		{"api.requests", resolvedLimit{limit: 100, priority: 1}},
+		// A glob matches the whole metric name
+		{"other.api.requests", resolvedLimit{limit: 10}},
+		{"db.queries.12", resolvedLimit{limit: 300, precision: 12}},
+		{"db.queries.slow", resolvedLimit{limit: 400}},
+		// Metric names matching no rule get the default limit
+		{"web.requests", resolvedLimit{limit: 10}},
+	} {
+		// Resolved twice, so the cached limit is checked too
+
+		for i := 0; i < 2; i++ {
+			if limit := limits.resolve(c.metricName); limit != c.want {
+				t.Fatalf("%s resolved to %+v, want %+v", c.metricName, limit, c.want)
+			}
+		}
+	}
+}
+
+func TestInvalidLimitRules(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		rule limitRule
+	}{
+		{"invalid regex", limitRule{namePattern: namePattern{Pattern: "api.(", Type: config.RuleTypeRegex}}},
+		{"invalid glob", limitRule{namePattern: namePattern{Pattern: "api.["}}},
+		{"invalid type", limitRule{namePattern: namePattern{Pattern: "api.*", Type: "prefix"}}},
+		{"negative priority", limitRule{namePattern: namePattern{Pattern: "api.*"}, Priority: -1}},
+		{"invalid precision", limitRule{namePattern: namePattern{Pattern: "api.*"}, Precision: 30}},
+	} {
+		if _, err := newLimitResolver(10, nil, []limitRule{c.rule}); err == nil {
+			t.Fatalf("%s: rule %+v loaded, want an error", c.name, c.rule)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"maps"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// Structs
+
+// seriesAccessor gives generic access to the series of each metric type, so the same logic can be used to
+// manipulate counters, gauges, timers and sets.
+type seriesAccessor[T any] struct {
+	tags    func(T) gostatsd.Tags
+	source  func(T) gostatsd.Source
+	setTags func(T, gostatsd.Tags, gostatsd.Source) T
+	merge   func(T, T) T
+	// values returns the number of values aggregated in a series, which is one for counters and gauges.
+	values func(T) int
+}
+
+// Static functions
+
+func counterAccessor() seriesAccessor[gostatsd.Counter] {
+	return seriesAccessor[gostatsd.Counter]{
+		tags:   func(c gostatsd.Counter) gostatsd.Tags { return c.Tags },
+		source: func(c gostatsd.Counter) gostatsd.Source { return c.Source },
+		setTags: func(c gostatsd.Counter, tags gostatsd.Tags, source gostatsd.Source) gostatsd.Counter {
+			c.Tags = tags
+			c.Source = source
+
+			return c
+		},
+		merge:  mergeCounter,
+		values: func(gostatsd.Counter) int { return 1 },
+	}
+}
+
+func gaugeAccessor(mergeRule string) seriesAccessor[gostatsd.Gauge] {
+	return seriesAccessor[gostatsd.Gauge]{
+		tags:   func(g gostatsd.Gauge) gostatsd.Tags { return g.Tags },
+		source: func(g gostatsd.Gauge) gostatsd.Source { return g.Source },
+		setTags: func(g gostatsd.Gauge, tags gostatsd.Tags, source gostatsd.Source) gostatsd.Gauge {
+			g.Tags = tags
+			g.Source = source
+
+			return g
+		},
+		merge: func(into gostatsd.Gauge, from gostatsd.Gauge) gostatsd.Gauge {
+			return mergeGauge(into, from, mergeRule)
+		},
+		values: func(gostatsd.Gauge) int { return 1 },
+	}
+}
+
+func timerAccessor() seriesAccessor[gostatsd.Timer] {
+	return seriesAccessor[gostatsd.Timer]{
+		tags:   func(t gostatsd.Timer) gostatsd.Tags { return t.Tags },
+		source: func(t gostatsd.Timer) gostatsd.Source { return t.Source },
+		setTags: func(t gostatsd.Timer, tags gostatsd.Tags, source gostatsd.Source) gostatsd.Timer {
+			t.Tags = tags
+			t.Source = source
+
+			return t
+		},
+		merge:  mergeTimer,
+		values: func(t gostatsd.Timer) int { return len(t.Values) },
+	}
+}
+
+func setAccessor() seriesAccessor[gostatsd.Set] {
+	return seriesAccessor[gostatsd.Set]{
+		tags:   func(s gostatsd.Set) gostatsd.Tags { return s.Tags },
+		source: func(s gostatsd.Set) gostatsd.Source { return s.Source },
+		setTags: func(s gostatsd.Set, tags gostatsd.Tags, source gostatsd.Source) gostatsd.Set {
+			s.Tags = tags
+			s.Source = source
+
+			return s
+		},
+		merge:  mergeSet,
+		values: func(s gostatsd.Set) int { return len(s.Values) },
+	}
+}
+
+func seriesCount[T any](metrics map[string]map[string]T) int {
+	count := 0
+
+	for _, series := range metrics {
+		count += len(series)
+	}
+
+	return count
+}
+
+// putSeries stores a series under the given tags key, merging it with the series already stored there, if any.
+func putSeries[T any](metrics map[string]map[string]T, metricName string, tagsKey string, value T, accessor seriesAccessor[T]) {
+	series, ok := metrics[metricName]
+
+	if !ok {
+		series = make(map[string]T)
+		metrics[metricName] = series
+	}
+
+	if existing, ok := series[tagsKey]; ok {
+		value = accessor.merge(existing, value)
+	}
+
+	series[tagsKey] = value
+}
+
+// copyMetricMap returns a copy of a metric map that can be modified without modifying the original one. The values
+// of the series are not deep copied, as they are only replaced, never modified in place.
+func copyMetricMap(metricMap *gostatsd.MetricMap) *gostatsd.MetricMap {
+	return &gostatsd.MetricMap{
+		Forwarded: metricMap.Forwarded,
+		Counters:  copySeries(metricMap.Counters),
+		Gauges:    copySeries(metricMap.Gauges),
+		Timers:    copySeries(metricMap.Timers),
+		Sets:      copySeries(metricMap.Sets),
+	}
+}
+
+func copySeries[M ~map[string]map[string]T, T any](metrics M) M {
+	copied := make(M, len(metrics))
+
+	for metricName, series := range metrics {
+		copied[metricName] = maps.Clone(series)
+	}
+
+	return copied
+}
@@ -0,0 +1,237 @@
+package backend
+
+import (
+	"cmp"
+	"fmt"
+	"time"
+
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/comfortablynumb/victor/internal/hyperloglog"
+	"github.com/comfortablynumb/victor/internal/util"
+	"github.com/spf13/viper"
+)
+
+// Structs
+
+// rateLimitSettings holds the configuration of a RateLimitedBackend that can be reloaded while it's running. It's
+// never modified once created: a reload swaps it for a new one.
+type rateLimitSettings struct {
+	limits               *limitResolver
+	eventLimit           uint64
+	maxEventKeys         int
+	clearAfterDuration   time.Duration
+	mode                 string
+	overflowGaugeMerge   string
+	tagValueLimiter      *tagValueLimiter
+	windowAlignment      *windowAlignment
+	totalBudget          *totalBudget
+	priorityClassifier   *priorityClassifier
+	tenancy              *tenancy
+	precision            uint8
+	maxMetricNames       int
+	maxMetricNamesPolicy string
+}
+
+// keyOptions returns the options of the new keys of the trackers other than the metric names one.
+func (s *rateLimitSettings) keyOptions() keyOptions {
+	return keyOptions{precision: s.precision}
+}
+
+// eventKeyOptions returns the options of the new keys of the events tracker. The least recently seen event keys are
+// evicted over maxEventKeys, so unique event titles can't grow it unbounded.
+func (s *rateLimitSettings) eventKeyOptions() keyOptions {
+	return keyOptions{
+		precision: s.precision,
+		maxKeys:   s.maxEventKeys,
+		policy:    config.MaxMetricNamesPolicyEvict,
+	}
+}
+
+// metricNameKeyOptions returns the options of the new keys of the metric names tracker, with the given precision of
+// the limit rule of the metric name, if any.
+func (s *rateLimitSettings) metricNameKeyOptions(precision uint8) keyOptions {
+	return keyOptions{
+		precision: cmp.Or(precision, s.precision),
+		maxKeys:   s.maxMetricNames,
+		policy:    s.maxMetricNamesPolicy,
+	}
+}
+
+// clearCaches clears the caches of the resolved limits and priority classes.
+func (s *rateLimitSettings) clearCaches() {
+	s.limits.clearCache()
+	s.priorityClassifier.clearCache()
+
+	for _, limits := range s.tenancy.limitsByTenant {
+		limits.limits.clearCache()
+	}
+}
+
+// Static functions
+
+// newRateLimitSettings reads the settings from the rate-limit viper. The tag value limiter uses the given tracker,
+// so its state survives reloads.
+func newRateLimitSettings(v *viper.Viper, hyperLogLogByTagKey *cardinalityTracker) (*rateLimitSettings, error) {
+	v.SetDefault(config.ParamDefaultLimit, config.DefaultLimit)
+	v.SetDefault(config.ParamEventLimit, config.DefaultEventLimit)
+	v.SetDefault(config.ParamMaxEventKeys, config.DefaultMaxEventKeys)
+	v.SetDefault(config.ParamClearAfterDuration, config.DefaultClearAfterDuration)
+	v.SetDefault(config.ParamLimitByMetricName, make(map[string]int))
+	v.SetDefault(config.ParamMode, config.DefaultMode)
+	v.SetDefault(config.ParamOverflowGaugeMerge, config.DefaultOverflowGaugeMerge)
+	v.SetDefault(config.ParamTotalLimitPolicy, config.DefaultTotalLimitPolicy)
+	v.SetDefault(config.ParamTotalLimitReserve, config.DefaultTotalLimitReserve)
+	v.SetDefault(config.ParamAlignWindows, false)
+	v.SetDefault(config.ParamAlignOffset, time.Duration(0))
+	v.SetDefault(config.ParamAlignTimezone, config.DefaultAlignTimezone)
+	v.SetDefault(config.ParamPrecision, hyperloglog.DefaultPrecision)
+	v.SetDefault(config.ParamMaxMetricNames, 0)
+	v.SetDefault(config.ParamMaxMetricNamesPolicy, config.DefaultMaxMetricNamesPolicy)
+
+	limit := v.GetUint64(config.ParamDefaultLimit)
+	eventLimit := v.GetUint64(config.ParamEventLimit)
+	clearAfterDuration := v.GetDuration(config.ParamClearAfterDuration)
+
+	if clearAfterDuration <= 0 {
+		return nil, fmt.Errorf("%s must be greater than zero. Value: %s", config.ParamClearAfterDuration, clearAfterDuration)
+	}
+
+	limitByMetricName, err := util.ConvertMap[string, int](v.GetStringMap(config.ParamLimitByMetricName))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s to map[string]int: %w", config.ParamLimitByMetricName, err)
+	}
+
+	var limitRules []limitRule
+
+	if err := v.UnmarshalKey(config.ParamLimitRules, &limitRules); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", config.ParamLimitRules, err)
+	}
+
+	limits, err := newLimitResolver(limit, limitByMetricName, limitRules)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var priorityClasses []priorityClass
+
+	if err := v.UnmarshalKey(config.ParamPriorityClasses, &priorityClasses); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", config.ParamPriorityClasses, err)
+	}
+
+	priorityClassifier, err := newPriorityClassifier(priorityClasses)
+
+	if err != nil {
+		return nil, err
+	}
+
+	totalLimitPolicy := v.GetString(config.ParamTotalLimitPolicy)
+
+	if totalLimitPolicy != config.TotalLimitPolicyFirstCome && totalLimitPolicy != config.TotalLimitPolicyPriority {
+		return nil, fmt.Errorf("invalid %s. Value: %s", config.ParamTotalLimitPolicy, totalLimitPolicy)
+	}
+
+	totalLimitReserve := v.GetInt(config.ParamTotalLimitReserve)
+
+	if totalLimitReserve < 0 || totalLimitReserve > 100 {
+		return nil, fmt.Errorf("invalid %s. Value: %d", config.ParamTotalLimitReserve, totalLimitReserve)
+	}
+
+	mode := v.GetString(config.ParamMode)
+
+	if mode != config.ModeDrop && mode != config.ModeOverflow && mode != config.ModeShadow {
+		return nil, fmt.Errorf("invalid %s. Value: %s", config.ParamMode, mode)
+	}
+
+	overflowGaugeMerge := v.GetString(config.ParamOverflowGaugeMerge)
+
+	switch overflowGaugeMerge {
+	case config.GaugeMergeLast, config.GaugeMergeMax, config.GaugeMergeMin, config.GaugeMergeSum:
+	default:
+		return nil, fmt.Errorf("invalid %s. Value: %s", config.ParamOverflowGaugeMerge, overflowGaugeMerge)
+	}
+
+	precision := v.GetUint(config.ParamPrecision)
+
+	if precision < hyperloglog.MinPrecision || precision > hyperloglog.MaxPrecision {
+		return nil, fmt.Errorf("invalid %s. Value: %d", config.ParamPrecision, precision)
+	}
+
+	maxMetricNames := v.GetInt(config.ParamMaxMetricNames)
+
+	if maxMetricNames < 0 {
+		return nil, fmt.Errorf("invalid %s. Value: %d", config.ParamMaxMetricNames, maxMetricNames)
+	}
+
+	maxEventKeys := v.GetInt(config.ParamMaxEventKeys)
+
+	if maxEventKeys < 0 {
+		return nil, fmt.Errorf("invalid %s. Value: %d", config.ParamMaxEventKeys, maxEventKeys)
+	}
+
+	maxMetricNamesPolicy := v.GetString(config.ParamMaxMetricNamesPolicy)
+
+	switch maxMetricNamesPolicy {
+	case config.MaxMetricNamesPolicyEvict, config.MaxMetricNamesPolicyDenyNew, config.MaxMetricNamesPolicyAdmitUntracked:
+	default:
+		return nil, fmt.Errorf("invalid %s. Value: %s", config.ParamMaxMetricNamesPolicy, maxMetricNamesPolicy)
+	}
+
+	var tagValueLimits []tagValueLimit
+
+	if err := v.UnmarshalKey(config.ParamTagValueLimits, &tagValueLimits); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", config.ParamTagValueLimits, err)
+	}
+
+	tagValueLimiter, err := newTagValueLimiter(tagValueLimits, hyperLogLogByTagKey, keyOptions{precision: uint8(precision)})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var alignment *windowAlignment
+
+	if v.GetBool(config.ParamAlignWindows) {
+		location, err := time.LoadLocation(v.GetString(config.ParamAlignTimezone))
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", config.ParamAlignTimezone, err)
+		}
+
+		alignment = &windowAlignment{
+			offset:   v.GetDuration(config.ParamAlignOffset),
+			location: location,
+		}
+	}
+
+	budget := &totalBudget{
+		limit:       v.GetUint64(config.ParamTotalLimit),
+		policy:      totalLimitPolicy,
+		reserve:     uint64(totalLimitReserve),
+		maxPriority: max(limits.maxPriority, priorityClassifier.maxPriority),
+	}
+
+	tenancy, err := newTenancy(util.GetSubViper(v, config.ParamTenants), limits, budget, priorityClassifier.maxPriority)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimitSettings{
+		limits:               limits,
+		eventLimit:           eventLimit,
+		maxEventKeys:         maxEventKeys,
+		clearAfterDuration:   clearAfterDuration,
+		mode:                 mode,
+		overflowGaugeMerge:   overflowGaugeMerge,
+		tagValueLimiter:      tagValueLimiter,
+		windowAlignment:      alignment,
+		totalBudget:          budget,
+		priorityClassifier:   priorityClassifier,
+		tenancy:              tenancy,
+		precision:            uint8(precision),
+		maxMetricNames:       maxMetricNames,
+		maxMetricNamesPolicy: maxMetricNamesPolicy,
+	}, nil
+}
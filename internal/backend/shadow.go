@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Constants
+
+// maxShadowedMetricNames is the maximum number of metric names listed in the shadow mode warnings, the ones with the
+// most series.
+const maxShadowedMetricNames = 10
+
+// logShadowedSeries logs in a single line how many series would have been rejected in shadow mode, with the metric
+// names with the most of them and a sampled example of their tags, so a cardinality explosion doesn't flood the logs.
+func (b *RateLimitedBackend) logShadowedSeries(rejectedByMetricType map[string]rejectedSeries) {
+	seriesByMetricName := make(map[string]int)
+	examples := make([]rewrittenSeries, 0, len(rejectedByMetricType))
+
+	for _, rejected := range rejectedByMetricType {
+		for metricName, tagsKeys := range rejected {
+			seriesByMetricName[metricName] += len(tagsKeys)
+			examples = append(examples, rewrittenSeries{metricName: metricName, tagsKey: tagsKeys[rand.IntN(len(tagsKeys))]})
+		}
+	}
+
+	if len(examples) == 0 {
+		return
+	}
+
+	example := examples[rand.IntN(len(examples))]
+
+	logrus.WithField("backend", b.Name()).
+		WithField("series", sumValues(seriesByMetricName)).
+		WithField("metric_names", len(seriesByMetricName)).
+		WithField("top", formatShadowedTop(seriesByMetricName)).
+		WithField("example_metric_name", example.metricName).
+		WithField("example_tags", example.tagsKey).
+		Warn("Series would be rejected by rate limit")
+}
+
+// logShadowedTagValues logs in a single line how many series would have had their tags rewritten or stripped in
+// shadow mode, with the metric names with the most of them and a sampled example of their tags.
+func (b *RateLimitedBackend) logShadowedTagValues(rewritten []rewrittenSeries) {
+	if len(rewritten) == 0 {
+		return
+	}
+
+	seriesByMetricName := make(map[string]int)
+
+	for _, r := range rewritten {
+		seriesByMetricName[r.metricName]++
+	}
+
+	example := rewritten[rand.IntN(len(rewritten))]
+
+	logrus.WithField("backend", b.Name()).
+		WithField("series", len(rewritten)).
+		WithField("metric_names", len(seriesByMetricName)).
+		WithField("top", formatShadowedTop(seriesByMetricName)).
+		WithField("example_metric_name", example.metricName).
+		WithField("example_tags", example.tagsKey).
+		WithField("example_limited_tags", example.tags).
+		Warn("Series would have their tag values limited by rate limit")
+}
+
+// Static functions
+
+// formatShadowedTop formats the metric names with the most series, with their count.
+func formatShadowedTop(seriesByMetricName map[string]int) string {
+	metricNames := slices.SortedFunc(maps.Keys(seriesByMetricName), func(a, b string) int {
+		return cmp.Or(cmp.Compare(seriesByMetricName[b], seriesByMetricName[a]), cmp.Compare(a, b))
+	})
+
+	top := make([]string, 0, maxShadowedMetricNames)
+
+	for _, metricName := range metricNames[:min(maxShadowedMetricNames, len(metricNames))] {
+		top = append(top, fmt.Sprintf("%s=%d", metricName, seriesByMetricName[metricName]))
+	}
+
+	return strings.Join(top, " ")
+}
+
+func sumValues(m map[string]int) int {
+	sum := 0
+
+	for _, v := range m {
+		sum += v
+	}
+
+	return sum
+}
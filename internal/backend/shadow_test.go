@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/spf13/viper"
+)
+
+func TestShadowEstimatesLimitedTagValues(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", 5)
+	v.Set("rate-limit.mode", "shadow")
+	v.Set("rate-limit.tag-value-limits", []any{map[string]any{"tag": "user", "limit": 2}})
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+	metricMap := newCounters("metric", 10)
+
+	for i := 0; i < 10; i++ {
+		tags := gostatsd.Tags{"user:" + strconv.Itoa(i)}
+
+		metricMap.MergeCounter("metric", tags[0], gostatsd.NewCounter(0, 1, "", tags))
+	}
+
+	b.rateLimit(b.settings.Load(), metricMap)
+
+	// The users over the limit would be rewritten into a single series, so 13 series are estimated instead of 20
+
+	tracked, _ := b.hyperLogLogByMetricName.get("metric")
+
+	if estimate := tracked.estimate(); estimate != 5 {
+		t.Fatalf("estimate is %d, want the limit", estimate)
+	}
+
+	if rejected := b.stats.counters.dropped.Load(); rejected != 8 {
+		t.Fatalf("%d series would be rejected, want the 13 series left after limiting the users, over the limit of 5", rejected)
+	}
+
+	if series := len(metricMap.Counters["metric"]); series != 20 {
+		t.Fatalf("%d series sent, want the 20 untouched ones", series)
+	}
+}
@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Structs
+
+// MetricState is the number of series of a metric name in the current window, and how many times a new series of it
+// was rejected, where a series rejected on several flushes counts every time.
+type MetricState struct {
+	Tenant      string `json:"tenant,omitempty"`
+	MetricName  string `json:"metric_name"`
+	Estimate    uint64 `json:"estimate"`
+	Limit       uint64 `json:"limit"`
+	Dropped     uint64 `json:"dropped"`
+	MemoryBytes uint64 `json:"memory_bytes"`
+}
+
+// TagValuesState is the number of distinct values of a tag key with a tag value limit, of a metric name if the limit
+// is scoped to one, and how many values were rewritten or stripped.
+type TagValuesState struct {
+	MetricName string `json:"metric_name,omitempty"`
+	TagKey     string `json:"tag_key"`
+	Estimate   uint64 `json:"estimate"`
+	Limit      uint64 `json:"limit"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+// TotalState is the number of series of all the metric names together, of a tenant if there are tenants. A zero
+// limit means there is no total limit.
+type TotalState struct {
+	Tenant   string `json:"tenant,omitempty"`
+	Estimate uint64 `json:"estimate"`
+	Limit    uint64 `json:"limit"`
+}
+
+// BackendState is the cardinality state of a backend. MemoryBytes is the approximate memory used by all its
+// HyperLogLogs, not only the ones of the metric names. DroppedValues is the number of values of the dropped series since
+// the backend started, by metric type, where a timer or a set has one by value, and a counter or a gauge only one.
+type BackendState struct {
+	Backend       string            `json:"backend"`
+	WindowStart   time.Time         `json:"window_start"`
+	MemoryBytes   uint64            `json:"memory_bytes"`
+	DroppedValues map[string]uint64 `json:"dropped_values"`
+	Total         *TotalState       `json:"total,omitempty"`
+	Tenants       []TotalState      `json:"tenants,omitempty"`
+	Metrics       []MetricState     `json:"metrics"`
+	TagValues     []TagValuesState  `json:"tag_values,omitempty"`
+}
+
+// State returns the current cardinality state of every tracked metric name, sorted by tenant and metric name, and of
+// every tag key with a tag value limit, sorted by metric name and tag key.
+func (b *RateLimitedBackend) State() BackendState {
+	metrics := make([]MetricState, 0)
+
+	settings := b.settings.Load()
+	memoryByKey := b.hyperLogLogByMetricName.memoryBytes()
+
+	b.hyperLogLogByMetricName.each(func(key string, estimate uint64, dropped uint64) {
+		tenant, metricName := splitTenantKey(key)
+		limits, _ := settings.limitsFor(tenant)
+
+		metrics = append(metrics, MetricState{
+			Tenant:      tenant,
+			MetricName:  metricName,
+			Estimate:    estimate,
+			Limit:       limits.limitFor(metricName),
+			Dropped:     dropped,
+			MemoryBytes: memoryByKey[key],
+		})
+	})
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Tenant != metrics[j].Tenant {
+			return metrics[i].Tenant < metrics[j].Tenant
+		}
+
+		return metrics[i].MetricName < metrics[j].MetricName
+	})
+
+	windowStart := time.Unix(atomic.LoadInt64(&b.lastClearTime), 0)
+
+	// With a sliding window, lastClearTime is the start of the current sub-window
+
+	if b.subWindows > 0 {
+		subWindowDuration := settings.clearAfterDuration / time.Duration(b.subWindows)
+
+		windowStart = windowStart.Add(-time.Duration(b.subWindows-1) * subWindowDuration)
+	}
+
+	state := BackendState{
+		Backend:       b.Name(),
+		WindowStart:   windowStart.UTC(),
+		DroppedValues: make(map[string]uint64),
+		Metrics:       metrics,
+	}
+
+	for metricType, s := range b.stats.byMetricType() {
+		if metricType != MetricTypeEvent {
+			state.DroppedValues[metricType] = s.droppedValues.Load()
+		}
+	}
+
+	for _, tracker := range []*cardinalityTracker{b.hyperLogLogByMetricName, b.hyperLogLogByEventKey, b.hyperLogLogByTagKey, b.hyperLogLogTotal} {
+		for _, memory := range tracker.memoryBytes() {
+			state.MemoryBytes += memory
+		}
+	}
+
+	b.hyperLogLogByTagKey.each(func(key string, estimate uint64, dropped uint64) {
+		metricName, tagKey, _ := strings.Cut(key, tagKeyValueSplit)
+		limit, _ := settings.tagValueLimiter.limitFor(metricName, tagKey)
+
+		state.TagValues = append(state.TagValues, TagValuesState{
+			MetricName: metricName,
+			TagKey:     tagKey,
+			Estimate:   estimate,
+			Limit:      limit.Limit,
+			Dropped:    dropped,
+		})
+	})
+
+	sort.Slice(state.TagValues, func(i, j int) bool {
+		if state.TagValues[i].MetricName != state.TagValues[j].MetricName {
+			return state.TagValues[i].MetricName < state.TagValues[j].MetricName
+		}
+
+		return state.TagValues[i].TagKey < state.TagValues[j].TagKey
+	})
+
+	switch {
+	case settings.tenancy.enabled():
+		state.Tenants = make([]TotalState, 0)
+
+		for tenant, estimate := range b.totalEstimates() {
+			_, budget := settings.limitsFor(tenant)
+
+			state.Tenants = append(state.Tenants, TotalState{Tenant: tenant, Estimate: estimate, Limit: budget.limit})
+		}
+
+		sort.Slice(state.Tenants, func(i, j int) bool {
+			return state.Tenants[i].Tenant < state.Tenants[j].Tenant
+		})
+	case settings.totalBudget.enabled():
+		state.Total = &TotalState{
+			Estimate: b.totalEstimates()[""],
+			Limit:    settings.totalBudget.limit,
+		}
+	}
+
+	return state
+}
+
+// ResetMetric forgets the cardinality state of a single metric name of a tenant, so it gets a full budget again. The
+// tenant is empty if there are no tenants. It returns whether the metric name was tracked.
+func (b *RateLimitedBackend) ResetMetric(tenant string, metricName string) bool {
+	return b.hyperLogLogByMetricName.reset(tenantKey(tenant, metricName))
+}
+
+// Reset forgets the whole cardinality state, starting a new window.
+func (b *RateLimitedBackend) Reset() {
+	b.clearHyperLogLogs(time.Now())
+}
+
+// ResetAt forgets the whole cardinality state, starting a new window at the given time.
+func (b *RateLimitedBackend) ResetAt(now time.Time) {
+	b.clearHyperLogLogs(now)
+}
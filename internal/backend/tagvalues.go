@@ -0,0 +1,171 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/config"
+)
+
+// Constants
+
+const (
+	OtherTagValue    = "__other__"
+	tagKeyValueSplit = ":"
+)
+
+// Structs
+
+// rewrittenSeries is a series whose tags were changed by the tag value limits, and its tags key after the change.
+type rewrittenSeries struct {
+	metricName string
+	tagsKey    string
+	tags       gostatsd.Tags
+	newTagsKey string
+}
+
+type tagValueLimit struct {
+	Tag        string `mapstructure:"tag"`
+	MetricName string `mapstructure:"metric-name"`
+	Limit      uint64 `mapstructure:"limit"`
+	Action     string `mapstructure:"action"`
+}
+
+// tagValueLimiter caps the distinct values of a tag key, optionally scoped to a metric name. Once the cap is hit,
+// the new values are rewritten to a placeholder or stripped, so the rest of the series is kept.
+type tagValueLimiter struct {
+	limitsByMetricName  map[string]map[string]tagValueLimit
+	hyperLogLogByTagKey *cardinalityTracker
+	keyOptions          keyOptions
+}
+
+func (l *tagValueLimiter) enabled() bool {
+	return len(l.limitsByMetricName) > 0
+}
+
+func (l *tagValueLimiter) limitFor(metricName string, tagKey string) (tagValueLimit, bool) {
+	if limit, ok := l.limitsByMetricName[metricName][tagKey]; ok {
+		return limit, true
+	}
+
+	limit, ok := l.limitsByMetricName[""][tagKey]
+
+	return limit, ok
+}
+
+// limitTags returns the tags with the over-limit values rewritten or stripped, and whether any tag was changed.
+func (l *tagValueLimiter) limitTags(metricName string, tags gostatsd.Tags) (gostatsd.Tags, bool) {
+	var newTags gostatsd.Tags
+
+	for i, tag := range tags {
+		limit, admitted := l.admit(metricName, tag)
+
+		if admitted {
+			if newTags != nil {
+				newTags = append(newTags, tag)
+			}
+
+			continue
+		}
+
+		if newTags == nil {
+			newTags = make(gostatsd.Tags, i, len(tags))
+
+			copy(newTags, tags[:i])
+		}
+
+		// The tag is stripped otherwise
+
+		if limit.Action == config.TagValueActionRewrite {
+			newTags = append(newTags, limit.Tag+tagKeyValueSplit+OtherTagValue)
+		}
+	}
+
+	if newTags == nil {
+		return tags, false
+	}
+
+	return newTags, true
+}
+
+// admit checks if the value of the tag is within the limit of its tag key. Tags without a limit are always admitted.
+func (l *tagValueLimiter) admit(metricName string, tag string) (tagValueLimit, bool) {
+	tagKey, tagValue, hasValue := strings.Cut(tag, tagKeyValueSplit)
+
+	if !hasValue {
+		return tagValueLimit{}, true
+	}
+
+	limit, ok := l.limitFor(metricName, tagKey)
+
+	if !ok {
+		return limit, true
+	}
+
+	admitted, _ := l.hyperLogLogByTagKey.insertIfBelow(limit.MetricName+tagKeyValueSplit+tagKey, tagValue, limit.Limit, l.keyOptions)
+
+	return limit, admitted
+}
+
+// Static functions
+
+func newTagValueLimiter(limits []tagValueLimit, hyperLogLogByTagKey *cardinalityTracker, keyOptions keyOptions) (*tagValueLimiter, error) {
+	limitsByMetricName := make(map[string]map[string]tagValueLimit)
+
+	for _, limit := range limits {
+		if limit.Tag == "" {
+			return nil, fmt.Errorf("tag value limit has no tag. Limit: %#v", limit)
+		}
+
+		if limit.Action == "" {
+			limit.Action = config.TagValueActionRewrite
+		}
+
+		if limit.Action != config.TagValueActionRewrite && limit.Action != config.TagValueActionStrip {
+			return nil, fmt.Errorf("tag value limit has an invalid action. Limit: %#v", limit)
+		}
+
+		if _, ok := limitsByMetricName[limit.MetricName]; !ok {
+			limitsByMetricName[limit.MetricName] = make(map[string]tagValueLimit)
+		}
+
+		limitsByMetricName[limit.MetricName][limit.Tag] = limit
+	}
+
+	return &tagValueLimiter{
+		limitsByMetricName:  limitsByMetricName,
+		hyperLogLogByTagKey: hyperLogLogByTagKey,
+		keyOptions:          keyOptions,
+	}, nil
+}
+
+// limitTagValues applies the tag value limits to every series, moving the series whose tags changed to their new
+// tags key, and returns them. Series that end up with the same tags are merged.
+func limitTagValues[T any](metrics map[string]map[string]T, limiter *tagValueLimiter, accessor seriesAccessor[T]) []rewrittenSeries {
+	var rewritten []rewrittenSeries
+
+	for metricName, series := range metrics {
+		for tagsKey, value := range series {
+			if tags, changed := limiter.limitTags(metricName, accessor.tags(value)); changed {
+				rewritten = append(rewritten, rewrittenSeries{
+					metricName: metricName,
+					tagsKey:    tagsKey,
+					tags:       tags,
+					newTagsKey: gostatsd.FormatTagsKey(accessor.source(value), tags),
+				})
+			}
+		}
+	}
+
+	for _, r := range rewritten {
+		value := metrics[r.metricName][r.tagsKey]
+		source := accessor.source(value)
+
+		delete(metrics[r.metricName], r.tagsKey)
+
+		putSeries(metrics, r.metricName, r.newTagsKey, accessor.setTags(value, r.tags, source), accessor)
+	}
+
+	return rewritten
+}
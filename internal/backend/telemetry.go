@@ -0,0 +1,166 @@
+package backend
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// Constants
+
+// maxTelemetryMetricNames is the maximum number of metric names with a gauge of their own in the internal metrics, the
+// ones with the highest estimates, so they don't grow with the cardinality Victor is there to limit.
+const maxTelemetryMetricNames = 100
+
+const (
+	MetricTypeCounter = "counter"
+	MetricTypeGauge   = "gauge"
+	MetricTypeTimer   = "timer"
+	MetricTypeSet     = "set"
+	MetricTypeEvent   = "event"
+)
+
+// Structs
+
+// seriesStats holds the series admitted and dropped since the last flush of the internal metrics, and the values of
+// the dropped series since the backend started, which are never reset.
+type seriesStats struct {
+	admitted      atomic.Uint64
+	dropped       atomic.Uint64
+	droppedValues atomic.Uint64
+}
+
+func (s *seriesStats) add(admitted int, dropped int) {
+	s.admitted.Add(uint64(admitted))
+	s.dropped.Add(uint64(dropped))
+}
+
+// keyEstimate is the estimate of a tracked key.
+type keyEstimate struct {
+	key      string
+	estimate uint64
+}
+
+// rateLimitStats holds the rate limit decisions taken since the last flush of the internal metrics.
+type rateLimitStats struct {
+	counters         seriesStats
+	gauges           seriesStats
+	timers           seriesStats
+	sets             seriesStats
+	events           seriesStats
+	windowResets     atomic.Uint64
+	totalDropped     atomic.Uint64
+	criticalAdmitted atomic.Uint64
+	tenantsFolded    atomic.Uint64
+}
+
+func (s *rateLimitStats) byMetricType() map[string]*seriesStats {
+	return map[string]*seriesStats{
+		MetricTypeCounter: &s.counters,
+		MetricTypeGauge:   &s.gauges,
+		MetricTypeTimer:   &s.timers,
+		MetricTypeSet:     &s.sets,
+		MetricTypeEvent:   &s.events,
+	}
+}
+
+// runMetrics emits the rate limit internal metrics on every flush, until the context is done.
+func (b *RateLimitedBackend) runMetrics(ctx context.Context, statser stats.Statser) {
+	statser = statser.WithTags(gostatsd.Tags{"backend:" + b.Name()})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			b.sendMetrics(statser)
+		}
+	}
+}
+
+func (b *RateLimitedBackend) sendMetrics(statser stats.Statser) {
+	for metricType, s := range b.stats.byMetricType() {
+		tags := gostatsd.Tags{"metric_type:" + metricType}
+
+		statser.Count("rate_limit.series.admitted", float64(s.admitted.Swap(0)), tags)
+		statser.Count("rate_limit.series.dropped", float64(s.dropped.Swap(0)), tags)
+	}
+
+	statser.Count("rate_limit.window.resets", float64(b.stats.windowResets.Swap(0)), nil)
+	statser.Count("rate_limit.series.critical", float64(b.stats.criticalAdmitted.Swap(0)), nil)
+
+	settings := b.settings.Load()
+
+	if settings.totalBudget.enabled() || settings.tenancy.enabled() {
+		statser.Count("rate_limit.total.dropped", float64(b.stats.totalDropped.Swap(0)), nil)
+
+		if settings.tenancy.enabled() {
+			statser.Count("rate_limit.tenants.folded", float64(b.stats.tenantsFolded.Swap(0)), nil)
+		}
+
+		for tenant, estimate := range b.totalEstimates() {
+			_, budget := settings.limitsFor(tenant)
+			tags := tenantTags(tenant)
+
+			statser.Gauge("rate_limit.total.cardinality", float64(estimate), tags)
+
+			if budget.enabled() {
+				statser.Gauge("rate_limit.total.utilization", float64(estimate)/float64(budget.limit), tags)
+			}
+		}
+	}
+
+	statser.Gauge("rate_limit.metric_names", float64(b.hyperLogLogByMetricName.size()), nil)
+
+	if settings.maxMetricNames > 0 {
+		statser.Count("rate_limit.metric_names.evicted", float64(b.hyperLogLogByMetricName.evicted.Swap(0)), nil)
+		statser.Count("rate_limit.metric_names.denied", float64(b.hyperLogLogByMetricName.deniedNew.Swap(0)), nil)
+		statser.Count("rate_limit.metric_names.untracked", float64(b.hyperLogLogByMetricName.admittedUntracked.Swap(0)), nil)
+	}
+
+	for _, tracked := range b.topMetricNames(maxTelemetryMetricNames) {
+		tenant, metricName := splitTenantKey(tracked.key)
+		limits, _ := settings.limitsFor(tenant)
+		tags := append(tenantTags(tenant), "metric_name:"+metricName)
+		limit := limits.limitFor(metricName)
+
+		statser.Gauge("rate_limit.cardinality", float64(tracked.estimate), tags)
+
+		if limit > 0 {
+			statser.Gauge("rate_limit.utilization", float64(tracked.estimate)/float64(limit), tags)
+		}
+	}
+}
+
+// topMetricNames returns the n tracked metric names with the highest estimates.
+func (b *RateLimitedBackend) topMetricNames(n int) []keyEstimate {
+	estimates := make([]keyEstimate, 0, b.hyperLogLogByMetricName.size())
+
+	b.hyperLogLogByMetricName.each(func(key string, estimate uint64, _ uint64) {
+		estimates = append(estimates, keyEstimate{key: key, estimate: estimate})
+	})
+
+	slices.SortFunc(estimates, func(a, b keyEstimate) int {
+		return cmp.Or(cmp.Compare(b.estimate, a.estimate), cmp.Compare(a.key, b.key))
+	})
+
+	return estimates[:min(n, len(estimates))]
+}
+
+// Static functions
+
+// tenantTags returns the tags of the internal metrics of a tenant, which are none without tenants.
+func tenantTags(tenant string) gostatsd.Tags {
+	if tenant == "" {
+		return gostatsd.Tags{}
+	}
+
+	return gostatsd.Tags{"tenant:" + tenant}
+}
@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/spf13/viper"
+)
+
+func TestTopMetricNames(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", 1000)
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+
+	for i := 1; i <= 200; i++ {
+		send(b, newCounters("metric."+strconv.Itoa(i), i%50))
+	}
+
+	top := b.topMetricNames(maxTelemetryMetricNames)
+
+	if len(top) != maxTelemetryMetricNames || top[0] != (keyEstimate{key: "metric.149", estimate: 49}) || top[len(top)-1].estimate != 25 {
+		t.Fatalf("top metric names are %v, want the 100 with the most series", top)
+	}
+}
+
+func TestDroppedValues(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", 2)
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+
+	// The same rejected series count again on every flush, and each value of a timer counts
+
+	for i := 0; i < 2; i++ {
+		metricMap := newCounters("metric", 5)
+
+		for j := 0; j < 3; j++ {
+			tags := gostatsd.Tags{"series:" + strconv.Itoa(j)}
+
+			metricMap.MergeTimer("timer", tags[0], gostatsd.NewTimer(0, []float64{1, 2}, "", tags))
+		}
+
+		send(b, metricMap)
+	}
+
+	if dropped := b.State().DroppedValues; dropped[MetricTypeCounter] != 6 || dropped[MetricTypeTimer] != 4 {
+		t.Fatalf("dropped values are %v, want 6 counters and 4 timer values", dropped)
+	}
+}
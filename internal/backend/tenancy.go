@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/spf13/viper"
+)
+
+// Constants
+
+// tenantKeySeparator separates the tenant from the metric name in the keys of the trackers. Neither tag values nor
+// metric names can contain it, as it's the separator of the statsd line protocol.
+const tenantKeySeparator = "|"
+
+// Structs
+
+type tenantLimitsConfig struct {
+	Tenant            string         `mapstructure:"tenant"`
+	DefaultLimit      *uint64        `mapstructure:"default-limit"`
+	LimitByMetricName map[string]int `mapstructure:"limit-by-metric-name"`
+	LimitRules        []limitRule    `mapstructure:"limit-rules"`
+	TotalLimit        *uint64        `mapstructure:"total-limit"`
+}
+
+// tenantLimits holds the limits of a tenant.
+type tenantLimits struct {
+	limits      *limitResolver
+	totalBudget *totalBudget
+}
+
+// tenancy derives the tenant of every series from a tag or from the prefix of its metric name, so each tenant gets
+// its own limits and its own cardinality state. The tenants without limits of their own get the ones of the backend.
+// Once maxTenants are tracked in the window, the series of any other tenant without limits of its own belong to the
+// default tenant, so a tag with many values can't multiply the limits.
+type tenancy struct {
+	tag             string
+	prefixSeparator string
+	defaultTenant   string
+	maxTenants      int
+	limitsByTenant  map[string]*tenantLimits
+}
+
+func (t *tenancy) enabled() bool {
+	return t.tag != "" || t.prefixSeparator != ""
+}
+
+// tenantOf returns the tenant of a series, or an empty string if the tenancy is not enabled.
+func (t *tenancy) tenantOf(metricName string, tags gostatsd.Tags) string {
+	if t.tag != "" {
+		prefix := t.tag + tagKeyValueSplit
+
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, prefix) && len(tag) > len(prefix) {
+				return tag[len(prefix):]
+			}
+		}
+
+		return t.defaultTenant
+	}
+
+	if t.prefixSeparator != "" {
+		if tenant, _, found := strings.Cut(metricName, t.prefixSeparator); found && tenant != "" {
+			return tenant
+		}
+
+		return t.defaultTenant
+	}
+
+	return ""
+}
+
+// listed returns whether a tenant always gets its own cardinality state, as it has limits of its own or it's the
+// default tenant.
+func (t *tenancy) listed(tenant string) bool {
+	if tenant == t.defaultTenant {
+		return true
+	}
+
+	_, ok := t.limitsByTenant[tenant]
+
+	return ok
+}
+
+// tenantOf returns the tenant of a series, folding it into the default tenant if it's a new tenant without limits of
+// its own and maxTenants are already tracked. The total tracker is keyed by tenant, so it holds the tracked tenants.
+func (b *RateLimitedBackend) tenantOf(settings *rateLimitSettings, metricName string, tags gostatsd.Tags) string {
+	t := settings.tenancy
+	tenant := t.tenantOf(metricName, tags)
+
+	if tenant == "" || t.maxTenants == 0 || t.listed(tenant) || b.hyperLogLogTotal.size() < t.maxTenants {
+		return tenant
+	}
+
+	if _, tracked := b.hyperLogLogTotal.get(tenant); tracked {
+		return tenant
+	}
+
+	b.stats.tenantsFolded.Add(1)
+
+	return t.defaultTenant
+}
+
+// limitsFor returns the limits of a tenant.
+func (s *rateLimitSettings) limitsFor(tenant string) (*limitResolver, *totalBudget) {
+	if limits, ok := s.tenancy.limitsByTenant[tenant]; ok {
+		return limits.limits, limits.totalBudget
+	}
+
+	return s.limits, s.totalBudget
+}
+
+// Static functions
+
+// tenantKey returns the key of a metric name of a tenant in the trackers. Without a tenant, it's the metric name.
+func tenantKey(tenant string, metricName string) string {
+	if tenant == "" {
+		return metricName
+	}
+
+	return tenant + tenantKeySeparator + metricName
+}
+
+// splitTenantKey returns the tenant and metric name of a key of the trackers.
+func splitTenantKey(key string) (string, string) {
+	if tenant, metricName, found := strings.Cut(key, tenantKeySeparator); found {
+		return tenant, metricName
+	}
+
+	return "", key
+}
+
+// newTenancy reads the tenancy from the tenants viper. The tenants inherit the default limit, the limits by metric
+// name, the limit rules and the total limit they don't override from the given backend limits.
+func newTenancy(v *viper.Viper, limits *limitResolver, budget *totalBudget, maxClassPriority int) (*tenancy, error) {
+	v.SetDefault(config.ParamDefaultTenant, config.DefaultTenant)
+	v.SetDefault(config.ParamMaxTenants, config.DefaultMaxTenants)
+
+	t := &tenancy{
+		tag:             v.GetString(config.ParamTenantTag),
+		prefixSeparator: v.GetString(config.ParamTenantPrefixSeparator),
+		defaultTenant:   v.GetString(config.ParamDefaultTenant),
+		maxTenants:      v.GetInt(config.ParamMaxTenants),
+		limitsByTenant:  make(map[string]*tenantLimits),
+	}
+
+	if t.tag != "" && t.prefixSeparator != "" {
+		return nil, fmt.Errorf("only one of %s and %s can be set", config.ParamTenantTag, config.ParamTenantPrefixSeparator)
+	}
+
+	if t.maxTenants < 0 {
+		return nil, fmt.Errorf("%s can't be negative. Value: %d", config.ParamMaxTenants, t.maxTenants)
+	}
+
+	var limitsConfigs []tenantLimitsConfig
+
+	if err := v.UnmarshalKey(config.ParamTenantLimits, &limitsConfigs); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", config.ParamTenantLimits, err)
+	}
+
+	for _, c := range limitsConfigs {
+		if c.Tenant == "" {
+			return nil, fmt.Errorf("tenant limits have no tenant. Limits: %#v", c)
+		}
+
+		defaultLimit := limits.defaultLimit
+		limitByMetricName := limits.limitByMetricName
+		limitRules := limits.rules
+		totalLimit := budget.limit
+
+		if c.DefaultLimit != nil {
+			defaultLimit = *c.DefaultLimit
+		}
+
+		if c.LimitByMetricName != nil {
+			limitByMetricName = c.LimitByMetricName
+		}
+
+		if c.LimitRules != nil {
+			limitRules = c.LimitRules
+		}
+
+		if c.TotalLimit != nil {
+			totalLimit = *c.TotalLimit
+		}
+
+		tenantLimitResolver, err := newLimitResolver(defaultLimit, limitByMetricName, limitRules)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid limits for tenant %s: %w", c.Tenant, err)
+		}
+
+		t.limitsByTenant[c.Tenant] = &tenantLimits{
+			limits: tenantLimitResolver,
+			totalBudget: &totalBudget{
+				limit:       totalLimit,
+				policy:      budget.policy,
+				reserve:     budget.reserve,
+				maxPriority: max(tenantLimitResolver.maxPriority, maxClassPriority),
+			},
+		}
+	}
+
+	return t, nil
+}
@@ -0,0 +1,39 @@
+package backend
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/spf13/viper"
+)
+
+func TestMaxTenants(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", 10)
+	v.Set("rate-limit.tenants", map[string]any{
+		"tag":         "team",
+		"max-tenants": 3,
+		"limits":      []any{map[string]any{"tenant": "payments", "default-limit": 5}},
+	})
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+	settings := b.settings.Load()
+
+	for i := 0; i < 10; i++ {
+		b.admit(settings, nil, "metric", "series:"+strconv.Itoa(i), gostatsd.Tags{"team:" + strconv.Itoa(i)})
+	}
+
+	b.admit(settings, nil, "metric", "series", gostatsd.Tags{"team:payments"})
+
+	totals := b.totalEstimates()
+
+	if len(totals) != 5 || totals["default"] != 7 || totals["payments"] != 1 {
+		t.Fatalf("series by tenant are %v, want 3 tenants and the rest in the default one, besides the listed one", totals)
+	}
+
+	if folded := b.stats.tenantsFolded.Load(); folded != 7 {
+		t.Fatalf("%d series folded, want 7", folded)
+	}
+}
@@ -0,0 +1,630 @@
+package backend
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/comfortablynumb/victor/internal/hyperloglog"
+	metro "github.com/dgryski/go-metro"
+)
+
+// Constants
+
+const (
+	// evictionBatchPercent is the percentage of the maximum number of keys evicted at once when a tracker is full, so
+	// finding the least recently seen keys is not done for every new key.
+	evictionBatchPercent = 1
+	// trackerShards is the number of shards of a tracker. It must be a power of two.
+	trackerShards = 64
+	shardSeed     = 7919
+)
+
+// Structs
+
+// keyOptions are the precision of the HyperLogLogs of the keys a tracker starts tracking, and the maximum number of
+// keys it tracks, along with what to do with new keys when it's full. A maxKeys of zero means no maximum.
+type keyOptions struct {
+	precision uint8
+	maxKeys   int
+	policy    string
+}
+
+// trackedKey holds the cardinality state of a single key. With a sliding window, it also holds a HyperLogLog per
+// sub-window, oldest first, and hyperLogLog is the merge of all of them. With peers, it also holds the merge of the
+// HyperLogLogs of the peers, and how much they add to the local estimate, so the estimate is the one of the cluster.
+type trackedKey struct {
+	hyperLogLog *hyperloglog.HyperLogLog
+	subWindows  []*hyperloglog.HyperLogLog
+	dropped     atomic.Uint64
+	lastSeen    atomic.Int64
+	peers       atomic.Pointer[hyperloglog.HyperLogLog]
+	peerExtra   atomic.Uint64
+}
+
+func (k *trackedKey) estimate() uint64 {
+	return k.hyperLogLog.Estimate() + k.peerExtra.Load()
+}
+
+// memoryBytes returns the approximate memory used by the HyperLogLogs of the key.
+func (k *trackedKey) memoryBytes() uint64 {
+	memory := k.hyperLogLog.MemoryBytes()
+
+	for _, subWindow := range k.subWindows {
+		memory += subWindow.MemoryBytes()
+	}
+
+	if peers := k.peers.Load(); peers != nil {
+		memory += peers.MemoryBytes()
+	}
+
+	return memory
+}
+
+// peersContain returns whether the tags with the given hash were admitted by a peer.
+func (k *trackedKey) peersContain(hash uint64) bool {
+	peers := k.peers.Load()
+
+	return peers != nil && peers.ContainsHash(hash)
+}
+
+// setPeers sets the merge of the HyperLogLogs of the peers, computing how much they add to the local estimate. As
+// the local HyperLogLog keeps growing until the next call, the cluster estimate may lag a bit behind.
+func (k *trackedKey) setPeers(peers *hyperloglog.HyperLogLog, exactThreshold int) error {
+	if peers == nil {
+		k.peers.Store(nil)
+		k.peerExtra.Store(0)
+
+		return nil
+	}
+
+	merged := hyperloglog.NewEmptyHyperLogLog(exactThreshold, k.hyperLogLog.Precision())
+
+	if err := merged.Merge(k.hyperLogLog); err != nil {
+		return err
+	}
+
+	if err := merged.Merge(peers); err != nil {
+		return err
+	}
+
+	local := k.hyperLogLog.Estimate()
+	cluster := merged.Estimate()
+
+	k.peers.Store(peers)
+	k.peerExtra.Store(cluster - min(local, cluster))
+
+	return nil
+}
+
+// trackerShard holds the keys of a tracker whose hash falls into it, so series of different keys rarely wait for each
+// other.
+type trackerShard struct {
+	trackedKeys map[string]*trackedKey
+	mutex       *sync.RWMutex
+}
+
+// cardinalityTracker keeps a HyperLogLog per key (a metric name, an event key, etc) to estimate how many distinct
+// tags combinations were admitted for it in the current window. With subWindows greater than zero, the window is a
+// sliding one made of that many sub-windows. The HyperLogLogs count exactly up to exactThreshold tags combinations.
+// The keys remember when they were last seen, as the time of the last tick, so the least recently seen ones can be
+// evicted when the tracker is full. The keys are spread over shards by their hash, each one with its own lock.
+type cardinalityTracker struct {
+	shards            []*trackerShard
+	keys              atomic.Int64
+	subWindows        int
+	exactThreshold    int
+	now               atomic.Int64
+	evicted           atomic.Uint64
+	deniedNew         atomic.Uint64
+	admittedUntracked atomic.Uint64
+	evictionMutex     *sync.Mutex
+}
+
+// tick sets the time the keys are seen at from now on, so the clock is not read for every series.
+func (t *cardinalityTracker) tick(now int64) {
+	t.now.Store(now)
+}
+
+// size returns the number of tracked keys.
+func (t *cardinalityTracker) size() int {
+	return int(t.keys.Load())
+}
+
+func (t *cardinalityTracker) clear() {
+	for _, shard := range t.shards {
+		shard.mutex.Lock()
+
+		t.keys.Add(-int64(len(shard.trackedKeys)))
+
+		shard.trackedKeys = make(map[string]*trackedKey)
+
+		shard.mutex.Unlock()
+	}
+}
+
+// rotate slides the window of every tracked key by the given number of sub-windows, forgetting the oldest ones. The
+// keys without any tags combination left are forgotten too.
+func (t *cardinalityTracker) rotate(rotations int) error {
+	for _, shard := range t.shards {
+		if err := t.rotateShard(shard, rotations); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *cardinalityTracker) rotateShard(shard *trackerShard, rotations int) error {
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	trackedKeys := make(map[string]*trackedKey, len(shard.trackedKeys))
+
+	for key, tracked := range shard.trackedKeys {
+		subWindows := tracked.subWindows[min(rotations, len(tracked.subWindows)):]
+
+		precision := tracked.hyperLogLog.Precision()
+
+		for len(subWindows) < t.subWindows {
+			subWindows = append(subWindows, t.newHyperLogLog(precision))
+		}
+
+		rotated, err := newTrackedKey(subWindows, t.exactThreshold, precision)
+
+		if err != nil {
+			return fmt.Errorf("failed to merge the HyperLogLogs of key %s: %w", key, err)
+		}
+
+		if rotated.hyperLogLog.Empty() {
+			continue
+		}
+
+		rotated.dropped.Store(tracked.dropped.Load())
+		rotated.lastSeen.Store(tracked.lastSeen.Load())
+
+		// The peers are kept until the next peer states arrive, but they add to a smaller local estimate now
+
+		if err := rotated.setPeers(tracked.peers.Load(), t.exactThreshold); err != nil {
+			return fmt.Errorf("failed to merge the peer HyperLogLogs of key %s: %w", key, err)
+		}
+
+		trackedKeys[key] = rotated
+	}
+
+	t.keys.Add(int64(len(trackedKeys) - len(shard.trackedKeys)))
+
+	shard.trackedKeys = trackedKeys
+
+	return nil
+}
+
+// reset forgets the state of a single key, and returns whether it was tracked.
+func (t *cardinalityTracker) reset(key string) bool {
+	shard := t.shardOf(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	_, found := shard.trackedKeys[key]
+
+	if found {
+		delete(shard.trackedKeys, key)
+
+		t.keys.Add(-1)
+	}
+
+	return found
+}
+
+// each calls the given function with the current estimate and dropped count of every tracked key.
+func (t *cardinalityTracker) each(f func(key string, estimate uint64, dropped uint64)) {
+	for key, tracked := range t.trackedKeys() {
+		f(key, tracked.estimate(), tracked.dropped.Load())
+	}
+}
+
+// memoryBytes returns the approximate memory used by the HyperLogLogs of every tracked key.
+func (t *cardinalityTracker) memoryBytes() map[string]uint64 {
+	memoryByKey := make(map[string]uint64, t.size())
+
+	for key, tracked := range t.trackedKeys() {
+		memoryByKey[key] = tracked.memoryBytes()
+	}
+
+	return memoryByKey
+}
+
+// trackedKeys returns a copy of the tracked keys of every shard.
+func (t *cardinalityTracker) trackedKeys() map[string]*trackedKey {
+	trackedKeys := make(map[string]*trackedKey, t.size())
+
+	for _, shard := range t.shards {
+		shard.mutex.RLock()
+
+		for key, tracked := range shard.trackedKeys {
+			trackedKeys[key] = tracked
+		}
+
+		shard.mutex.RUnlock()
+	}
+
+	return trackedKeys
+}
+
+// setPeers sets the merged HyperLogLogs of the peers by key. The keys only tracked by the peers start being tracked
+// with the options of each key, so their first tags combinations are limited too, unless the tracker is full.
+func (t *cardinalityTracker) setPeers(peersByKey map[string]*hyperloglog.HyperLogLog, optionsOf func(key string) keyOptions) error {
+	for key := range peersByKey {
+		options := optionsOf(key)
+
+		if options.maxKeys > 0 && t.size() >= options.maxKeys {
+			break
+		}
+
+		t.getOrAdd(key, options.precision)
+	}
+
+	// Merging the HyperLogLogs is expensive, so it's done without holding any lock
+
+	for key, tracked := range t.trackedKeys() {
+		if err := tracked.setPeers(peersByKey[key], t.exactThreshold); err != nil {
+			return fmt.Errorf("failed to merge the peer HyperLogLogs of key %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// snapshot encodes the state of every tracked key. With full, as it's saved to the state file, it includes the
+// HyperLogLogs of its sub-windows and the tags admitted once promoted. Without it, as it's shared with the peers, only
+// the sketch of a promoted HyperLogLog is included, so its size is bounded. The state of the peers is not included.
+func (t *cardinalityTracker) snapshot(full bool) (map[string]persistedKey, error) {
+	persistedKeys := make(map[string]persistedKey, t.size())
+	marshal := (*hyperloglog.HyperLogLog).MarshalSketch
+
+	if full {
+		marshal = (*hyperloglog.HyperLogLog).MarshalBinary
+	}
+
+	for key, tracked := range t.trackedKeys() {
+		hyperLogLog, err := marshal(tracked.hyperLogLog)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the HyperLogLog of key %s: %w", key, err)
+		}
+
+		persisted := persistedKey{
+			HyperLogLog: hyperLogLog,
+			Dropped:     tracked.dropped.Load(),
+			LastSeen:    tracked.lastSeen.Load(),
+		}
+
+		for _, subWindow := range tracked.subWindows {
+			if !full {
+				break
+			}
+
+			encoded, err := subWindow.MarshalBinary()
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode a sub-window HyperLogLog of key %s: %w", key, err)
+			}
+
+			persisted.SubWindows = append(persisted.SubWindows, encoded)
+		}
+
+		persistedKeys[key] = persisted
+	}
+
+	return persistedKeys, nil
+}
+
+// restore replaces the tracked keys with the ones of a snapshot, keeping the time they were last seen at.
+func (t *cardinalityTracker) restore(persistedKeys map[string]persistedKey) error {
+	restoreTime := time.Now().Unix()
+	trackedKeysByShard := make(map[*trackerShard]map[string]*trackedKey, len(t.shards))
+
+	for _, shard := range t.shards {
+		trackedKeysByShard[shard] = make(map[string]*trackedKey)
+	}
+
+	for key, persisted := range persistedKeys {
+		if len(persisted.SubWindows) != t.subWindows {
+			return fmt.Errorf("key %s was saved with %d sub-windows, but %d are configured", key, len(persisted.SubWindows), t.subWindows)
+		}
+
+		tracked := &trackedKey{
+			hyperLogLog: t.newHyperLogLog(hyperloglog.DefaultPrecision),
+		}
+
+		if err := tracked.hyperLogLog.UnmarshalBinary(persisted.HyperLogLog); err != nil {
+			return fmt.Errorf("failed to decode the HyperLogLog of key %s: %w", key, err)
+		}
+
+		for _, encoded := range persisted.SubWindows {
+			subWindow := t.newHyperLogLog(hyperloglog.DefaultPrecision)
+
+			if err := subWindow.UnmarshalBinary(encoded); err != nil {
+				return fmt.Errorf("failed to decode a sub-window HyperLogLog of key %s: %w", key, err)
+			}
+
+			tracked.subWindows = append(tracked.subWindows, subWindow)
+		}
+
+		tracked.dropped.Store(persisted.Dropped)
+
+		// The keys of a state file saved before the time they were last seen was are taken as seen now, so they are
+		// not evicted ahead of the ones actually idle
+
+		tracked.lastSeen.Store(cmp.Or(persisted.LastSeen, restoreTime))
+
+		trackedKeysByShard[t.shardOf(key)][key] = tracked
+	}
+
+	for shard, trackedKeys := range trackedKeysByShard {
+		shard.mutex.Lock()
+
+		t.keys.Add(int64(len(trackedKeys) - len(shard.trackedKeys)))
+
+		shard.trackedKeys = trackedKeys
+
+		shard.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// remove removes the tags just inserted in a key, when another limit rejects them after all, so they are not known to
+// the key and don't use its budget. Once the HyperLogLog of the key is a sketch, they may still count toward its
+// estimate, as a register can't be rolled back.
+func (t *cardinalityTracker) remove(key string, tags string) {
+	val, found := t.get(key)
+
+	if !found {
+		return
+	}
+
+	hash := hyperloglog.Hash(tags)
+
+	val.hyperLogLog.RemoveHash(hash)
+
+	if len(val.subWindows) > 0 {
+		val.subWindows[len(val.subWindows)-1].RemoveHash(hash)
+	}
+}
+
+// admits returns whether insertIfBelow would admit the given tags, without inserting them.
+func (t *cardinalityTracker) admits(key string, tags string, limit uint64) bool {
+	val, found := t.get(key)
+
+	if !found {
+		return true
+	}
+
+	hash := hyperloglog.Hash(tags)
+
+	return val.hyperLogLog.ContainsHash(hash) || val.peersContain(hash) || val.estimate() < limit
+}
+
+// insertIfBelow inserts the tags of a key as long as its estimate is below the given limit, and returns whether they
+// are admitted, and whether they are new to the key, admitted or not. The series already admitted in the current
+// window, locally or by a peer, are always admitted, as they don't increase the cardinality.
+func (t *cardinalityTracker) insertIfBelow(key string, tags string, limit uint64, options keyOptions) (bool, bool) {
+	val, found := t.get(key)
+
+	if !found {
+		if full, admitted := t.full(options); full {
+			return admitted, true
+		}
+
+		val = t.getOrAdd(key, options.precision)
+	}
+
+	if now := t.now.Load(); val.lastSeen.Load() != now {
+		val.lastSeen.Store(now)
+	}
+
+	hash := hyperloglog.Hash(tags)
+
+	// The peers take their share of the limit, so the local HyperLogLog is limited to the rest of it
+
+	peerExtra := val.peerExtra.Load()
+
+	if admitted, inserted := val.hyperLogLog.InsertIfBelow(hash, limit-min(peerExtra, limit)); admitted {
+		// With a sliding window, the series are inserted in the current sub-window too, so they do not expire while
+		// they keep being sent
+
+		if len(val.subWindows) > 0 {
+			insertInSubWindow(val.subWindows[len(val.subWindows)-1], hash, limit)
+		}
+
+		return true, inserted
+	}
+
+	if val.peersContain(hash) {
+		return true, false
+	}
+
+	val.dropped.Add(1)
+
+	return false, true
+}
+
+// full returns whether the tracker is full, and if so, whether the tags of a new key are admitted without tracking
+// it, depending on the policy. With the eviction policy, the least recently seen keys are evicted to make room for it
+// instead.
+func (t *cardinalityTracker) full(options keyOptions) (bool, bool) {
+	if options.maxKeys == 0 || t.size() < options.maxKeys {
+		return false, false
+	}
+
+	switch options.policy {
+	case config.MaxMetricNamesPolicyDenyNew:
+		t.deniedNew.Add(1)
+
+		return true, false
+	case config.MaxMetricNamesPolicyAdmitUntracked:
+		t.admittedUntracked.Add(1)
+
+		return true, true
+	default:
+		t.evictLeastRecentlySeen(options.maxKeys)
+
+		return false, false
+	}
+}
+
+// getOrAdd returns the tracked key, starting to track it without any tags if it's not tracked yet. The key is checked
+// and added under the lock of its shard, so concurrent series of a new key all get the same one.
+func (t *cardinalityTracker) getOrAdd(key string, precision uint8) *trackedKey {
+	shard := t.shardOf(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	tracked, found := shard.trackedKeys[key]
+
+	if !found {
+		tracked = t.newEmptyTrackedKey(precision)
+		shard.trackedKeys[key] = tracked
+
+		t.keys.Add(1)
+	}
+
+	return tracked
+}
+
+func (t *cardinalityTracker) get(key string) (*trackedKey, bool) {
+	shard := t.shardOf(key)
+
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	tracked, found := shard.trackedKeys[key]
+
+	return tracked, found
+}
+
+func (t *cardinalityTracker) shardOf(key string) *trackerShard {
+	return t.shards[metro.Hash64Str(key, shardSeed)&(trackerShards-1)]
+}
+
+// evictLeastRecentlySeen forgets the least recently seen keys, so a batch of new keys fits under maxKeys. Only one
+// eviction runs at a time, and the series of other keys are not blocked while the keys are sorted. As new keys may be
+// added in the meantime, maxKeys may be briefly exceeded.
+func (t *cardinalityTracker) evictLeastRecentlySeen(maxKeys int) {
+	t.evictionMutex.Lock()
+	defer t.evictionMutex.Unlock()
+
+	// Another series may have evicted them while this one waited
+	if t.size() < maxKeys {
+		return
+	}
+
+	count := t.size() - maxKeys + max(1, maxKeys*evictionBatchPercent/100)
+
+	type keyLastSeen struct {
+		shard    *trackerShard
+		key      string
+		lastSeen int64
+	}
+
+	keys := make([]keyLastSeen, 0, t.size())
+
+	for _, shard := range t.shards {
+		shard.mutex.RLock()
+
+		for key, tracked := range shard.trackedKeys {
+			keys = append(keys, keyLastSeen{shard: shard, key: key, lastSeen: tracked.lastSeen.Load()})
+		}
+
+		shard.mutex.RUnlock()
+	}
+
+	slices.SortFunc(keys, func(a, b keyLastSeen) int {
+		return cmp.Compare(a.lastSeen, b.lastSeen)
+	})
+
+	for _, k := range keys[:min(count, len(keys))] {
+		k.shard.mutex.Lock()
+
+		if _, found := k.shard.trackedKeys[k.key]; found {
+			delete(k.shard.trackedKeys, k.key)
+
+			t.keys.Add(-1)
+			t.evicted.Add(1)
+		}
+
+		k.shard.mutex.Unlock()
+	}
+}
+
+func (t *cardinalityTracker) newEmptyTrackedKey(precision uint8) *trackedKey {
+	tracked := &trackedKey{
+		hyperLogLog: t.newHyperLogLog(precision),
+	}
+
+	for i := 0; i < t.subWindows; i++ {
+		tracked.subWindows = append(tracked.subWindows, t.newHyperLogLog(precision))
+	}
+
+	return tracked
+}
+
+func (t *cardinalityTracker) newHyperLogLog(precision uint8) *hyperloglog.HyperLogLog {
+	return hyperloglog.NewEmptyHyperLogLog(t.exactThreshold, precision)
+}
+
+// Static functions
+
+// insertInSubWindow inserts a hash admitted below the given limit in a sub-window. The hashes admitted below a limit
+// stay known by the sub-window once promoted, so they are still known after the window slides.
+func insertInSubWindow(subWindow *hyperloglog.HyperLogLog, hash uint64, limit uint64) {
+	if limit == math.MaxUint64 {
+		subWindow.InsertIfBelow(hash, limit)
+	} else if !subWindow.ContainsHash(hash) {
+		subWindow.InsertAdmittedHash(hash)
+	}
+}
+
+// newTrackedKey returns a trackedKey for the given sub-windows, merging them.
+func newTrackedKey(subWindows []*hyperloglog.HyperLogLog, exactThreshold int, precision uint8) (*trackedKey, error) {
+	tracked := &trackedKey{
+		hyperLogLog: hyperloglog.NewEmptyHyperLogLog(exactThreshold, precision),
+		subWindows:  subWindows,
+	}
+
+	for _, subWindow := range subWindows {
+		if err := tracked.hyperLogLog.Merge(subWindow); err != nil {
+			return nil, err
+		}
+	}
+
+	return tracked, nil
+}
+
+// newCardinalityTracker returns a tracker with a fixed window if subWindows is zero, or a sliding window made of
+// subWindows sub-windows otherwise.
+func newCardinalityTracker(subWindows int, exactThreshold int) *cardinalityTracker {
+	t := &cardinalityTracker{
+		shards:         make([]*trackerShard, trackerShards),
+		subWindows:     subWindows,
+		exactThreshold: exactThreshold,
+		evictionMutex:  &sync.Mutex{},
+	}
+
+	for i := range t.shards {
+		t.shards[i] = &trackerShard{
+			trackedKeys: make(map[string]*trackedKey),
+			mutex:       &sync.RWMutex{},
+		}
+	}
+
+	return t
+}
@@ -0,0 +1,380 @@
+package backend
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/comfortablynumb/victor/internal/hyperloglog"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// nullBackend discards every metric, so only the rate limiting is measured.
+type nullBackend struct{}
+
+func (n *nullBackend) Name() string {
+	return "null"
+}
+
+func (n *nullBackend) SendMetricsAsync(_ context.Context, _ *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	callback(nil)
+}
+
+func (n *nullBackend) SendEvent(_ context.Context, _ *gostatsd.Event) error {
+	return nil
+}
+
+var defaultKeyOptions = keyOptions{precision: hyperloglog.DefaultPrecision}
+
+func TestInsertIfBelow(t *testing.T) {
+	tracker := newCardinalityTracker(0, config.DefaultExactThreshold)
+
+	for i := 0; i < 10; i++ {
+		admitted, isNew := tracker.insertIfBelow("metric", "series:"+strconv.Itoa(i), 5, defaultKeyOptions)
+
+		if admitted != (i < 5) || !isNew {
+			t.Fatalf("series %d: admitted %t, new %t", i, admitted, isNew)
+		}
+	}
+
+	if admitted, isNew := tracker.insertIfBelow("metric", "series:0", 5, defaultKeyOptions); !admitted || isNew {
+		t.Fatalf("known series: admitted %t, new %t", admitted, isNew)
+	}
+
+	tracker.each(func(key string, estimate uint64, dropped uint64) {
+		if estimate != 5 || dropped != 5 {
+			t.Fatalf("key %s: estimate %d, dropped %d", key, estimate, dropped)
+		}
+	})
+}
+
+// TestInsertIfBelowPastExactThreshold feeds far more distinct series than the limit, past the exact threshold, and
+// checks that the limit is an upper bound within the error of the sketch, and that the admitted series keep flowing.
+func TestInsertIfBelowPastExactThreshold(t *testing.T) {
+	const limit = 10000
+
+	maxAdmitted := limit * (1 + 4*1.04/math.Sqrt(1<<hyperloglog.DefaultPrecision))
+
+	for _, subWindows := range []int{0, 3} {
+		tracker := newCardinalityTracker(subWindows, config.DefaultExactThreshold)
+		admitted := 0
+
+		for i := 0; i < 1_000_000; i++ {
+			if ok, _ := tracker.insertIfBelow("metric", "series:"+strconv.Itoa(i), limit, defaultKeyOptions); ok {
+				admitted++
+			}
+		}
+
+		if float64(admitted) > maxAdmitted {
+			t.Fatalf("%d sub-windows: admitted %d series over a limit of %d", subWindows, admitted, limit)
+		}
+
+		if subWindows > 0 {
+			if err := tracker.rotate(1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < admitted; i++ {
+			if ok, _ := tracker.insertIfBelow("metric", "series:"+strconv.Itoa(i), limit, defaultKeyOptions); !ok {
+				t.Fatalf("%d sub-windows: admitted series %d was rejected", subWindows, i)
+			}
+		}
+	}
+}
+
+func TestInsertIfBelowConcurrently(t *testing.T) {
+	tracker := newCardinalityTracker(0, config.DefaultExactThreshold)
+
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				key := "metric." + strconv.Itoa(i%10)
+
+				if ok, _ := tracker.insertIfBelow(key, strconv.Itoa(g)+":"+strconv.Itoa(i), 50, defaultKeyOptions); ok {
+					admitted.Add(1)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if tracker.size() != 10 || admitted.Load() != 500 {
+		t.Fatalf("%d keys admitted %d series, want 10 keys admitting 500", tracker.size(), admitted.Load())
+	}
+}
+
+func TestMaxKeysPolicies(t *testing.T) {
+	for policy, wantAdmitted := range map[string]bool{
+		config.MaxMetricNamesPolicyDenyNew:        false,
+		config.MaxMetricNamesPolicyAdmitUntracked: true,
+		config.MaxMetricNamesPolicyEvict:          true,
+	} {
+		tracker := newCardinalityTracker(0, config.DefaultExactThreshold)
+		options := keyOptions{precision: hyperloglog.DefaultPrecision, maxKeys: 100, policy: policy}
+
+		for i := 0; i < 100; i++ {
+			tracker.tick(int64(i))
+			tracker.insertIfBelow("metric."+strconv.Itoa(i), "series", 10, options)
+		}
+
+		admitted, _ := tracker.insertIfBelow("metric.new", "series", 10, options)
+
+		if admitted != wantAdmitted || tracker.size() > 100 {
+			t.Fatalf("policy %s: admitted %t with %d keys", policy, admitted, tracker.size())
+		}
+
+		if _, found := tracker.get("metric.0"); policy == config.MaxMetricNamesPolicyEvict && found {
+			t.Fatal("the least recently seen key was not evicted")
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	tracker := newCardinalityTracker(2, config.DefaultExactThreshold)
+
+	tracker.insertIfBelow("metric", "old", 10, defaultKeyOptions)
+
+	if err := tracker.rotate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.insertIfBelow("metric", "new", 10, defaultKeyOptions)
+
+	if err := tracker.rotate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	tracked, _ := tracker.get("metric")
+
+	if tracked.estimate() != 1 || !tracked.hyperLogLog.Contains("new") {
+		t.Fatalf("estimate is %d after the old sub-window expired, want 1", tracked.estimate())
+	}
+
+	if err := tracker.rotate(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if tracker.size() != 0 {
+		t.Fatal("the key without series left was not forgotten")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	tracker := newCardinalityTracker(0, 10)
+
+	for i := 0; i < 100; i++ {
+		tracker.tick(int64(i%2) + 1)
+		tracker.insertIfBelow("metric."+strconv.Itoa(i%2), "series:"+strconv.Itoa(i), 1000, defaultKeyOptions)
+	}
+
+	snapshot, err := tracker.snapshot(false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newCardinalityTracker(0, 10)
+
+	if err := restored.restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.size() != 2 {
+		t.Fatalf("%d keys restored, want 2", restored.size())
+	}
+
+	for key, tracked := range tracker.trackedKeys() {
+		restoredKey, _ := restored.get(key)
+
+		if restoredKey.estimate() != tracked.estimate() {
+			t.Fatalf("key %s: estimate %d restored as %d", key, tracked.estimate(), restoredKey.estimate())
+		}
+	}
+
+	// The least recently seen key is still evicted first after a restore
+
+	restored.evictLeastRecentlySeen(2)
+
+	if _, ok := restored.get("metric.0"); ok || restored.size() != 1 {
+		t.Fatalf("%d keys left after evicting one, want the least recently seen one evicted", restored.size())
+	}
+}
+
+func TestMaxEventKeys(t *testing.T) {
+	v := viper.New()
+
+	v.Set("rate-limit.max-event-keys", 10)
+
+	b := NewRateLimitedBackend(&nullBackend{}, v)
+
+	for i := 0; i < 100; i++ {
+		if err := b.SendEvent(context.Background(), &gostatsd.Event{Title: "event " + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if size := b.hyperLogLogByEventKey.size(); size > 10 {
+		t.Fatalf("%d event keys tracked, want 10 at most", size)
+	}
+}
+
+// The benchmarks send a flush of the given number of series spread over the given number of metric names. The default
+// exact threshold is 1000, so the metric names of the second case are promoted to a sketch.
+var benchmarkFlushes = []struct {
+	name        string
+	series      int
+	metricNames int
+}{
+	{name: "1M series over 1000 names", series: 1_000_000, metricNames: 1_000},
+	{name: "1M series over 100 names", series: 1_000_000, metricNames: 100},
+}
+
+func BenchmarkNewSeries(b *testing.B) {
+	for _, flush := range benchmarkFlushes {
+		b.Run(flush.name, func(b *testing.B) {
+			rateLimited := newBenchmarkBackend(b, flush.series/flush.metricNames, config.WindowFixed)
+			metricMap, _ := newMetricMaps(flush.series, flush.metricNames, 1)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				rateLimited.Reset()
+				b.StartTimer()
+
+				send(rateLimited, metricMap)
+			}
+
+			reportSeriesPerSecond(b, flush.series)
+		})
+	}
+}
+
+// BenchmarkRejectedSeries sends series of metric names already at their limit, as during a cardinality explosion.
+func BenchmarkRejectedSeries(b *testing.B) {
+	for _, flush := range benchmarkFlushes {
+		b.Run(flush.name, func(b *testing.B) {
+			rateLimited := newBenchmarkBackend(b, flush.series/flush.metricNames/2, config.WindowFixed)
+			metricMap, _ := newMetricMaps(flush.series, flush.metricNames, 1)
+
+			send(rateLimited, metricMap)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				send(rateLimited, metricMap)
+			}
+
+			reportSeriesPerSecond(b, flush.series)
+		})
+	}
+}
+
+func BenchmarkKnownSeries(b *testing.B) {
+	for _, window := range []string{config.WindowFixed, config.WindowSliding} {
+		for _, flush := range benchmarkFlushes {
+			b.Run(window+" window, "+flush.name, func(b *testing.B) {
+				rateLimited := newBenchmarkBackend(b, flush.series/flush.metricNames, window)
+				metricMap, _ := newMetricMaps(flush.series, flush.metricNames, 1)
+
+				send(rateLimited, metricMap)
+
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					send(rateLimited, metricMap)
+				}
+
+				reportSeriesPerSecond(b, flush.series)
+			})
+		}
+	}
+}
+
+// BenchmarkKnownSeriesConcurrently sends a part of the metric names from every goroutine, as concurrent flushes do.
+func BenchmarkKnownSeriesConcurrently(b *testing.B) {
+	for _, flush := range benchmarkFlushes {
+		b.Run(flush.name, func(b *testing.B) {
+			parts := runtime.GOMAXPROCS(0)
+			rateLimited := newBenchmarkBackend(b, flush.series/flush.metricNames, config.WindowFixed)
+			metricMap, metricMapParts := newMetricMaps(flush.series, flush.metricNames, parts)
+
+			send(rateLimited, metricMap)
+
+			var next atomic.Int64
+
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				part := metricMapParts[int(next.Add(1)-1)%parts]
+
+				for pb.Next() {
+					send(rateLimited, part)
+				}
+			})
+
+			reportSeriesPerSecond(b, flush.series/parts)
+		})
+	}
+}
+
+func newBenchmarkBackend(b *testing.B, limit int, window string) *RateLimitedBackend {
+	b.Helper()
+	b.ReportAllocs()
+
+	logrus.SetLevel(logrus.WarnLevel)
+
+	v := viper.New()
+
+	v.Set("rate-limit.default-limit", limit)
+	v.Set("rate-limit.window", window)
+
+	return NewRateLimitedBackend(&nullBackend{}, v)
+}
+
+func reportSeriesPerSecond(b *testing.B, seriesPerOp int) {
+	b.ReportMetric(float64(seriesPerOp)*float64(b.N)/b.Elapsed().Seconds(), "series/s")
+}
+
+func send(b gostatsd.Backend, metricMap *gostatsd.MetricMap) {
+	b.SendMetricsAsync(context.Background(), metricMap, func([]error) {})
+}
+
+// newMetricMaps returns a metric map with the given number of counters spread over the given number of metric names,
+// along with the same counters split into the given number of metric maps by metric name.
+func newMetricMaps(series int, metricNames int, parts int) (*gostatsd.MetricMap, []*gostatsd.MetricMap) {
+	metricMap := gostatsd.NewMetricMap(false)
+	metricMapParts := make([]*gostatsd.MetricMap, parts)
+
+	for i := range metricMapParts {
+		metricMapParts[i] = gostatsd.NewMetricMap(false)
+	}
+
+	for i := 0; i < series; i++ {
+		metricName := "bench.metric." + strconv.Itoa(i%metricNames)
+		tags := gostatsd.Tags{"series:" + strconv.Itoa(i), "env:bench"}
+		tagsKey := tags[1] + "," + tags[0]
+		counter := gostatsd.NewCounter(0, 1, "", tags)
+
+		metricMap.MergeCounter(metricName, tagsKey, counter)
+		metricMapParts[(i%metricNames)%parts].MergeCounter(metricName, tagsKey, counter)
+	}
+
+	return metricMap, metricMapParts
+}
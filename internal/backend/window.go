@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"context"
+	"time"
+)
+
+// Constants
+
+// windowSchedulerInterval is how often the scheduler checks if the current window ended.
+const windowSchedulerInterval = 1 * time.Second
+
+// Structs
+
+// windowAlignment aligns the windows to wall-clock boundaries in a timezone, shifted by an offset. For example, 1h
+// windows aligned in UTC start at the top of every hour, as the custom metrics of most vendors are billed.
+type windowAlignment struct {
+	offset   time.Duration
+	location *time.Location
+}
+
+// windowStart returns the start of the aligned window of the given period that now falls in.
+func (a *windowAlignment) windowStart(now time.Time, period time.Duration) time.Time {
+	_, zoneOffset := now.In(a.location).Zone()
+
+	shift := time.Duration(zoneOffset)*time.Second - a.offset
+
+	return now.Add(shift).Truncate(period).Add(-shift)
+}
+
+// runWindowScheduler ends the windows on time, even if the backend is not receiving anything.
+func (b *RateLimitedBackend) runWindowScheduler(ctx context.Context) {
+	ticker := time.NewTicker(windowSchedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.maybeClearHyperLogLogs(time.Now())
+		}
+	}
+}
+
+// EndWindows ends the window, or slides it with a sliding window, if it ended by the given time, and returns whether
+// it did. It's what the backend does every second with the wall clock when it runs, so traffic captured in the past
+// can be replayed through a backend that doesn't.
+func (b *RateLimitedBackend) EndWindows(now time.Time) bool {
+	return b.maybeClearHyperLogLogs(now)
+}
+
+// windowPeriod returns how often the window is cleared, or slid with a sliding window.
+func (b *RateLimitedBackend) windowPeriod(settings *rateLimitSettings) time.Duration {
+	if b.subWindows > 0 {
+		return settings.clearAfterDuration / time.Duration(b.subWindows)
+	}
+
+	return settings.clearAfterDuration
+}
+
+// windowStart returns the start of the window of the given period that now falls in, as a unix timestamp. Without
+// alignment, the windows start every period since lastClearTime.
+func (s *rateLimitSettings) windowStart(now time.Time, lastClearTime int64, period time.Duration) int64 {
+	if s.windowAlignment != nil {
+		return s.windowAlignment.windowStart(now, period).Unix()
+	}
+
+	periodSeconds := max(int64(period/time.Second), 1)
+	elapsed := max(now.Unix()-lastClearTime, 0)
+
+	return lastClearTime + elapsed/periodSeconds*periodSeconds
+}
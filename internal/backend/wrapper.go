@@ -1,20 +1,32 @@
-package backend
-
-import (
-	"github.com/atlassian/gostatsd"
-	"github.com/comfortablynumb/victor/internal/config"
-	"github.com/comfortablynumb/victor/internal/util"
-	"github.com/spf13/viper"
-)
-
-// Static functions
-
-func NewWrappedBackend(backend gostatsd.Backend, v *viper.Viper) gostatsd.Backend {
-	rateLimitViper := util.GetSubViper(v, config.ParamRateLimit)
-
-	if rateLimitViper.GetBool(config.ParamEnabled) {
-		return NewRateLimitedBackend(backend, v)
-	}
-
-	return backend
-}
+package backend
+
+import (
+	"github.com/atlassian/gostatsd"
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/comfortablynumb/victor/internal/util"
+	"github.com/spf13/viper"
+)
+
+// Static functions
+
+func NewWrappedBackend(backend gostatsd.Backend, v *viper.Viper) gostatsd.Backend {
+	rateLimitViper := util.GetSubViper(v, config.ParamRateLimit)
+
+	if rateLimitViper.GetBool(config.ParamEnabled) {
+		return NewRateLimitedBackend(backend, v)
+	}
+
+	return backend
+}
+
+// NewSharedRateLimitedBackend rate limits the given backends once, before the fan-out, if the shared rate limit is
+// enabled in the given viper. Otherwise, it returns nil.
+func NewSharedRateLimitedBackend(backends []gostatsd.Backend, v *viper.Viper) *RateLimitedBackend {
+	rateLimitViper := util.GetSubViper(v, config.ParamRateLimit)
+
+	if !rateLimitViper.GetBool(config.ParamEnabled) {
+		return nil
+	}
+
+	return NewRateLimitedBackend(NewFanOutBackend(backends), v)
+}
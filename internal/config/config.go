@@ -1,20 +1,139 @@
-package config
-
-import "time"
-
-// Constants
-
-const (
-	ParamBackends  = "backends"
-	ParamRateLimit = "rate-limit"
-
-	// Rate Limit Configs
-
-	ParamClearAfterDuration = "clear-after-duration"
-	ParamDefaultLimit       = "default-limit"
-	ParamLimitByMetricName  = "limit-by-metric-name"
-	ParamEnabled            = "enabled"
-
-	DefaultClearAfterDuration = 1 * time.Hour
-	DefaultLimit              = 10000
-)
+package config
+
+import "time"
+
+// Constants
+
+const (
+	ParamBackends  = "backends"
+	ParamRateLimit = "rate-limit"
+
+	// SharedBackendName is the name of the backend that rate limits every backend once, before the fan-out. Its
+	// configuration is under this key too.
+	SharedBackendName = "shared"
+
+	// ForwardBackendName is the name of the backend that forwards every metric name to the aggregator Victor that
+	// owns it on a consistent hash ring. Its configuration is under this key too.
+	ForwardBackendName = "forward"
+
+	// Forward Configs
+
+	ParamForwardMembers      = "members"
+	ParamForwardMembersFile  = "members-file"
+	ParamForwardVirtualNodes = "virtual-nodes"
+	ParamForwardTCPTransport = "tcp-transport"
+	ParamForwardDialTimeout  = "dial-timeout"
+	ParamForwardWriteTimeout = "write-timeout"
+	ParamForwardSendTimeout  = "send-timeout"
+
+	// Peers Configs
+
+	ParamPeers        = "peers"
+	ParamPeerListen   = "listen"
+	ParamPeerStatic   = "static"
+	ParamPeerDNS      = "dns"
+	ParamPeerDNSPort  = "dns-port"
+	ParamPeerInterval = "interval"
+	ParamPeerTimeout  = "timeout"
+
+	// Rate Limit Configs
+
+	ParamClearAfterDuration   = "clear-after-duration"
+	ParamDefaultLimit         = "default-limit"
+	ParamEventLimit           = "event-limit"
+	ParamMaxEventKeys         = "max-event-keys"
+	ParamLimitByMetricName    = "limit-by-metric-name"
+	ParamLimitRules           = "limit-rules"
+	ParamTotalLimit           = "total-limit"
+	ParamTotalLimitPolicy     = "total-limit-policy"
+	ParamTotalLimitReserve    = "total-limit-reserve"
+	ParamPriorityClasses      = "priority-classes"
+	ParamTenants              = "tenants"
+	ParamEnabled              = "enabled"
+	ParamMode                 = "mode"
+	ParamOverflowGaugeMerge   = "overflow-gauge-merge"
+	ParamTagValueLimits       = "tag-value-limits"
+	ParamStateFile            = "state-file"
+	ParamStateSaveInterval    = "state-save-interval"
+	ParamWindow               = "window"
+	ParamSubWindows           = "sub-windows"
+	ParamExactThreshold       = "exact-threshold"
+	ParamPrecision            = "precision"
+	ParamMaxMetricNames       = "max-metric-names"
+	ParamMaxMetricNamesPolicy = "max-metric-names-policy"
+	ParamAlignWindows         = "align-windows"
+	ParamAlignOffset          = "align-offset"
+	ParamAlignTimezone        = "align-timezone"
+	ParamTopOffenders         = "top-offenders"
+	ParamTopOffendersLog      = "top-offenders-log-interval"
+
+	// Tenants Configs
+
+	ParamTenantTag             = "tag"
+	ParamTenantPrefixSeparator = "prefix-separator"
+	ParamDefaultTenant         = "default-tenant"
+	ParamMaxTenants            = "max-tenants"
+	ParamTenantLimits          = "limits"
+
+	// Rate Limit Modes
+
+	ModeDrop     = "drop"
+	ModeOverflow = "overflow"
+	ModeShadow   = "shadow"
+
+	// Window Types
+
+	WindowFixed   = "fixed"
+	WindowSliding = "sliding"
+
+	// Total Limit Policies
+
+	TotalLimitPolicyFirstCome = "first-come"
+	TotalLimitPolicyPriority  = "priority"
+
+	// Max Metric Names Policies
+
+	MaxMetricNamesPolicyEvict          = "evict-lru"
+	MaxMetricNamesPolicyDenyNew        = "deny-new"
+	MaxMetricNamesPolicyAdmitUntracked = "admit-untracked"
+
+	// Gauge Merge Rules
+
+	GaugeMergeLast = "last"
+	GaugeMergeMax  = "max"
+	GaugeMergeMin  = "min"
+	GaugeMergeSum  = "sum"
+
+	// Limit Rule Types
+
+	RuleTypeGlob  = "glob"
+	RuleTypeRegex = "regex"
+
+	// Tag Value Limit Actions
+
+	TagValueActionRewrite = "rewrite"
+	TagValueActionStrip   = "strip"
+
+	DefaultClearAfterDuration   = 1 * time.Hour
+	DefaultLimit                = 10000
+	DefaultEventLimit           = 1000
+	DefaultMaxEventKeys         = 10000
+	DefaultMode                 = ModeDrop
+	DefaultOverflowGaugeMerge   = GaugeMergeLast
+	DefaultTotalLimitPolicy     = TotalLimitPolicyFirstCome
+	DefaultTotalLimitReserve    = 10
+	DefaultStateSaveInterval    = 1 * time.Minute
+	DefaultTopOffendersLog      = 1 * time.Hour
+	DefaultWindow               = WindowFixed
+	DefaultSubWindows           = 6
+	DefaultExactThreshold       = 1000
+	DefaultMaxMetricNamesPolicy = MaxMetricNamesPolicyEvict
+	DefaultAlignTimezone        = "UTC"
+	DefaultTenant               = "default"
+	DefaultMaxTenants           = 100
+	DefaultPeerInterval         = 10 * time.Second
+	DefaultPeerTimeout          = 5 * time.Second
+	DefaultForwardDialTimeout   = 5 * time.Second
+	DefaultForwardWriteTimeout  = 30 * time.Second
+	DefaultForwardSendTimeout   = 10 * time.Second
+)
@@ -1,41 +1,531 @@
-package hyperloglog
-
-import (
-	"sync"
-
-	"github.com/axiomhq/hyperloglog"
-)
-
-// Structs
-
-type HyperLogLog struct {
-	sketch *hyperloglog.Sketch
-	mutex  *sync.RWMutex
-}
-
-func (h *HyperLogLog) Insert(tags string) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-
-	h.sketch.Insert([]byte(tags))
-}
-
-func (h *HyperLogLog) Estimate() uint64 {
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
-
-	return h.sketch.Estimate()
-}
-
-// Static functions
-
-func NewHyperLogLog(tags string) *HyperLogLog {
-	sketch := hyperloglog.New14()
-
-	sketch.Insert([]byte(tags))
-
-	return &HyperLogLog{
-		sketch: sketch,
-		mutex:  &sync.RWMutex{},
-	}
-}
+package hyperloglog
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"sync"
+
+	metro "github.com/dgryski/go-metro"
+)
+
+// Constants
+
+const (
+	// hashSeed is the seed of the hash of the inserted tags, which also picks their register once promoted.
+	hashSeed = 1337
+
+	// memberBytes is the approximate memory used by each hash of the set of inserted tags.
+	memberBytes = 16
+
+	MinPrecision     = 4
+	MaxPrecision     = 18
+	DefaultPrecision = 14
+)
+
+// alphaInf is the bias correction of the estimator, for an infinite number of registers.
+var alphaInf = 1 / (2 * math.Ln2)
+
+// Structs
+
+// encodedHyperLogLog is the binary representation of a HyperLogLog: the hashes of the inserted tags, and the registers
+// of the sketch once promoted.
+type encodedHyperLogLog struct {
+	Registers []byte
+	Members   []uint64
+	Precision uint8
+}
+
+// HyperLogLog counts the distinct inserted tags. Up to exactThreshold tags combinations, it keeps the set of their
+// hashes, so the count is exact, and a caller can check if a given combination was already inserted. Past it, the
+// HyperLogLog is promoted to a sketch of 2^precision registers, which estimates the count from then on. A sketch can't
+// tell which combinations were inserted, so the set only keeps growing with the ones admitted below a limit, which
+// bounds it, and the ones inserted without a limit are only counted. Each extra bit of precision doubles the memory of
+// the sketch, and divides its error by the square root of two.
+// Once promoted, it keeps how many registers have each value, and the estimate it gives, which is only computed again
+// after a register changes, so checking a limit does not go through every register.
+type HyperLogLog struct {
+	members        map[uint64]struct{}
+	registers      []uint8
+	histogram      []uint32
+	estimated      uint64
+	stale          bool
+	exactThreshold int
+	precision      uint8
+	mutex          *sync.RWMutex
+}
+
+func (h *HyperLogLog) Insert(tags string) {
+	h.InsertHash(Hash(tags))
+}
+
+// InsertHash inserts tags given their Hash, so callers inserting the same tags into several HyperLogLogs hash them
+// only once.
+func (h *HyperLogLog) InsertHash(hash uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.insertHash(hash)
+}
+
+// RemoveHash removes tags given their Hash, so they are not known anymore. Before the HyperLogLog is promoted, they
+// don't count anymore either, but once promoted they may still count, as a register can't be rolled back.
+func (h *HyperLogLog) RemoveHash(hash uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.members, hash)
+}
+
+func (h *HyperLogLog) Contains(tags string) bool {
+	return h.ContainsHash(Hash(tags))
+}
+
+// ContainsHash returns whether tags were inserted, given their Hash. Once promoted, only the tags inserted before it
+// was, and the ones admitted below a limit since, are known.
+func (h *HyperLogLog) ContainsHash(hash uint64) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.containsHash(hash)
+}
+
+// Estimate returns the count of distinct inserted tags.
+func (h *HyperLogLog) Estimate() uint64 {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.estimate()
+}
+
+// InsertIfBelow inserts tags given their Hash, as long as the count is below the given limit, and returns whether
+// they were admitted, and whether they were inserted, as opposed to being already there. Tags already admitted are
+// always admitted, as they don't increase the count. The count is checked and the tags inserted under the same lock,
+// so concurrent callers never take the count past the limit. Without a limit (math.MaxUint64), the tags that would
+// not change the sketch are taken as already inserted, as there is nothing to enforce.
+func (h *HyperLogLog) InsertIfBelow(hash uint64, limit uint64) (bool, bool) {
+	h.mutex.RLock()
+
+	found := h.containsHash(hash) || (limit == math.MaxUint64 && h.sketchContainsHash(hash))
+
+	// At the limit, the new tags are rejected without waiting for the write lock, unless the estimate is stale
+
+	full := !found && !h.stale && h.estimate() >= limit
+
+	h.mutex.RUnlock()
+
+	if found {
+		return true, false
+	}
+
+	if full {
+		return false, false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.containsHash(hash) {
+		return true, false
+	}
+
+	h.refresh()
+
+	if h.estimate() >= limit {
+		return false, false
+	}
+
+	if limit == math.MaxUint64 {
+		h.insertHash(hash)
+	} else {
+		h.insertAdmittedHash(hash)
+	}
+
+	return true, true
+}
+
+// InsertAdmittedHash inserts tags given their Hash, that were admitted below a limit somewhere else, so they are
+// known once promoted too.
+func (h *HyperLogLog) InsertAdmittedHash(hash uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.insertAdmittedHash(hash)
+}
+
+func (h *HyperLogLog) Precision() uint8 {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.precision
+}
+
+// Promoted returns whether the count is estimated by a sketch instead of being exact.
+func (h *HyperLogLog) Promoted() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.registers != nil
+}
+
+// MemoryBytes returns an approximation of the memory used by the HyperLogLog: the hashes of the inserted tags, and
+// the registers of the sketch once promoted.
+func (h *HyperLogLog) MemoryBytes() uint64 {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return uint64(len(h.registers)) + uint64(len(h.members))*memberBytes
+}
+
+// Empty returns whether no tags were inserted.
+func (h *HyperLogLog) Empty() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.registers == nil && len(h.members) == 0
+}
+
+// Merge inserts every tags combination of the given HyperLogLog into this one. If the given one is promoted, this one
+// is promoted too, and its registers take the highest value of both. When their precisions differ, the result takes
+// the lowest one. The tags known by either one are known by the result.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	other.mutex.RLock()
+
+	members := make([]uint64, 0, len(other.members))
+
+	for hash := range other.members {
+		members = append(members, hash)
+	}
+
+	registers := slices.Clone(other.registers)
+	precision := other.precision
+
+	other.mutex.RUnlock()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if registers != nil {
+		h.promote()
+
+		if precision < h.precision {
+			h.registers = fold(h.registers, h.precision, precision)
+			h.precision = precision
+		} else if precision > h.precision {
+			registers = fold(registers, precision, h.precision)
+		}
+
+		for i, value := range registers {
+			h.registers[i] = max(h.registers[i], value)
+		}
+
+		h.countRegisters()
+	}
+
+	for _, hash := range members {
+		h.insertAdmittedHash(hash)
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes the hashes of the inserted tags, and the registers of the sketch once promoted.
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	return h.marshal(true)
+}
+
+// MarshalSketch encodes the hashes of the inserted tags, or only the registers of the sketch once promoted, so the
+// encoding is bounded by the exact threshold or the precision. The tags admitted once promoted are not known by the
+// decoded HyperLogLog.
+func (h *HyperLogLog) MarshalSketch() ([]byte, error) {
+	return h.marshal(false)
+}
+
+func (h *HyperLogLog) marshal(withMembers bool) ([]byte, error) {
+	h.mutex.RLock()
+
+	encoded := encodedHyperLogLog{
+		Registers: slices.Clone(h.registers),
+		Precision: h.precision,
+	}
+
+	if withMembers || h.registers == nil {
+		encoded.Members = make([]uint64, 0, len(h.members))
+
+		for hash := range h.members {
+			encoded.Members = append(encoded.Members, hash)
+		}
+	}
+
+	h.mutex.RUnlock()
+
+	var buffer bytes.Buffer
+
+	if err := gob.NewEncoder(&buffer).Encode(encoded); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	var encoded encodedHyperLogLog
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&encoded); err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// The sketch takes the precision it was encoded with
+	if encoded.Precision != 0 {
+		if encoded.Precision < MinPrecision || encoded.Precision > MaxPrecision {
+			return fmt.Errorf("invalid precision. Value: %d", encoded.Precision)
+		}
+
+		h.precision = encoded.Precision
+	}
+
+	if len(encoded.Registers) > 0 && len(encoded.Registers) != 1<<h.precision {
+		return fmt.Errorf("invalid number of registers for precision %d. Value: %d", h.precision, len(encoded.Registers))
+	}
+
+	h.members = make(map[uint64]struct{}, len(encoded.Members))
+	h.registers = nil
+
+	if len(encoded.Registers) > 0 {
+		h.registers = encoded.Registers
+
+		h.countRegisters()
+	}
+
+	for _, hash := range encoded.Members {
+		h.insertAdmittedHash(hash)
+	}
+
+	return nil
+}
+
+// containsHash returns whether the tags with the given hash are known. The caller must hold a lock.
+func (h *HyperLogLog) containsHash(hash uint64) bool {
+	_, found := h.members[hash]
+
+	return found
+}
+
+// sketchContainsHash returns whether inserting the given hash would leave the sketch untouched, which is always the
+// case for the tags already inserted, but also for many others. The caller must hold a lock.
+func (h *HyperLogLog) sketchContainsHash(hash uint64) bool {
+	if h.registers == nil {
+		return false
+	}
+
+	index, value := register(hash, h.precision)
+
+	return h.registers[index] >= value
+}
+
+// estimate returns the count of distinct inserted tags. The caller must hold a lock.
+func (h *HyperLogLog) estimate() uint64 {
+	if h.registers == nil {
+		return uint64(len(h.members))
+	}
+
+	if h.stale {
+		return estimateRegisters(h.histogram, h.precision)
+	}
+
+	return h.estimated
+}
+
+// refresh computes the estimate again if a register changed since the last time. The caller must hold the write
+// lock.
+func (h *HyperLogLog) refresh() {
+	if h.stale {
+		h.estimated = estimateRegisters(h.histogram, h.precision)
+		h.stale = false
+	}
+}
+
+// insertHash inserts a hash, promoting the HyperLogLog to a sketch when the exact threshold is crossed. Once promoted,
+// the hash is only counted. The caller must hold the write lock.
+func (h *HyperLogLog) insertHash(hash uint64) {
+	if h.registers != nil {
+		h.setRegister(register(hash, h.precision))
+
+		return
+	}
+
+	h.insertAdmittedHash(hash)
+}
+
+// insertAdmittedHash inserts a hash that stays known once promoted. The caller must hold the write lock.
+func (h *HyperLogLog) insertAdmittedHash(hash uint64) {
+	h.members[hash] = struct{}{}
+
+	if h.registers != nil {
+		h.setRegister(register(hash, h.precision))
+	} else if len(h.members) > h.exactThreshold {
+		h.promote()
+	}
+}
+
+// promote allocates the registers of the sketch, inserting every hash inserted so far, which stay known. The caller
+// must hold the write lock.
+func (h *HyperLogLog) promote() {
+	if h.registers != nil {
+		return
+	}
+
+	h.registers = make([]uint8, 1<<h.precision)
+
+	h.countRegisters()
+
+	for hash := range h.members {
+		h.setRegister(register(hash, h.precision))
+	}
+}
+
+// setRegister raises a register to the given value, if it's higher. The caller must hold the write lock.
+func (h *HyperLogLog) setRegister(index uint64, value uint8) {
+	current := h.registers[index]
+
+	if value <= current {
+		return
+	}
+
+	h.registers[index] = value
+	h.histogram[current]--
+	h.histogram[value]++
+	h.stale = true
+}
+
+// countRegisters counts how many registers have each value, from scratch. The caller must hold the write lock.
+func (h *HyperLogLog) countRegisters() {
+	h.histogram = make([]uint32, 64-int(h.precision)+2)
+
+	for _, value := range h.registers {
+		h.histogram[value]++
+	}
+
+	h.stale = true
+}
+
+// Static functions
+
+// NewEmptyHyperLogLog returns a HyperLogLog without any tags inserted, which counts exactly up to exactThreshold tags
+// combinations, and then estimates with a sketch of the given precision. Mostly useful to unmarshal one.
+func NewEmptyHyperLogLog(exactThreshold int, precision uint8) *HyperLogLog {
+	return &HyperLogLog{
+		members:        make(map[uint64]struct{}),
+		exactThreshold: exactThreshold,
+		precision:      precision,
+		mutex:          &sync.RWMutex{},
+	}
+}
+
+func NewHyperLogLog(tags string, exactThreshold int, precision uint8) *HyperLogLog {
+	h := NewEmptyHyperLogLog(exactThreshold, precision)
+
+	h.Insert(tags)
+
+	return h
+}
+
+// Hash returns the hash the tags are inserted with.
+func Hash(tags string) uint64 {
+	return metro.Hash64Str(tags, hashSeed)
+}
+
+// register returns the register of a hash, picked by its first precision bits, and the value it sets it to: the
+// position of the first set bit of the rest of the hash.
+func register(hash uint64, precision uint8) (uint64, uint8) {
+	return hash >> (64 - precision), uint8(min(bits.LeadingZeros64(hash<<precision), 64-int(precision))) + 1
+}
+
+// fold returns the registers of a sketch of the given precision as the ones of a sketch of a lower one. The index bits
+// the lower precision drops become the first bits of the rest of the hash.
+func fold(registers []uint8, from uint8, to uint8) []uint8 {
+	folded := make([]uint8, 1<<to)
+	shift := from - to
+
+	for i, value := range registers {
+		if value == 0 {
+			continue
+		}
+
+		dropped := uint64(i) & (1<<shift - 1)
+		value += shift
+
+		if dropped != 0 {
+			value = uint8(bits.LeadingZeros64(dropped<<(64-shift))) + 1
+		}
+
+		folded[i>>shift] = max(folded[i>>shift], value)
+	}
+
+	return folded
+}
+
+// estimateRegisters estimates the count of a sketch from the number of registers with each value, with the improved
+// raw estimator of Otmar Ertl's "New cardinality estimation algorithms for HyperLogLog sketches", which is unbiased
+// from small to large counts without empirical corrections.
+func estimateRegisters(histogram []uint32, precision uint8) uint64 {
+	m := float64(uint64(1) << precision)
+	q := 64 - int(precision)
+
+	z := m * tau((m-float64(histogram[q+1]))/m)
+
+	for k := q; k >= 1; k-- {
+		z += float64(histogram[k])
+		z *= 0.5
+	}
+
+	z += m * sigma(float64(histogram[0])/m)
+
+	return uint64(math.Round(alphaInf * m * m / z))
+}
+
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y := 1.0
+	z := x
+
+	for {
+		x *= x
+		previous := z
+		z += x * y
+		y += y
+
+		if z == previous {
+			return z
+		}
+	}
+}
+
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y := 1.0
+	z := 1 - x
+
+	for {
+		x = math.Sqrt(x)
+		previous := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+
+		if z == previous {
+			return z / 3
+		}
+	}
+}
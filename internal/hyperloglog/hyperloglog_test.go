@@ -0,0 +1,216 @@
+package hyperloglog
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// maxRelativeError is four standard errors of a sketch of the default precision.
+var maxRelativeError = 4 * 1.04 / math.Sqrt(1<<DefaultPrecision)
+
+func TestExactBelowThreshold(t *testing.T) {
+	h := NewEmptyHyperLogLog(100, DefaultPrecision)
+
+	for i := 0; i < 100; i++ {
+		h.Insert("series:" + strconv.Itoa(i))
+		h.Insert("series:" + strconv.Itoa(i))
+	}
+
+	if h.Promoted() {
+		t.Fatal("promoted at the threshold")
+	}
+
+	if estimate := h.Estimate(); estimate != 100 {
+		t.Fatalf("estimate is %d, want 100", estimate)
+	}
+
+	if !h.Contains("series:7") || h.Contains("series:100") {
+		t.Fatal("wrong membership below the threshold")
+	}
+}
+
+func TestPromotionKeepsOnlyAdmittedMembers(t *testing.T) {
+	h := NewEmptyHyperLogLog(100, DefaultPrecision)
+
+	for i := 0; i < 10000; i++ {
+		h.Insert("series:" + strconv.Itoa(i))
+	}
+
+	if !h.Promoted() {
+		t.Fatal("not promoted past the threshold")
+	}
+
+	// Only the series inserted before the promotion are known, as the rest were inserted without a limit
+
+	if memory := h.MemoryBytes(); memory != 1<<DefaultPrecision+101*memberBytes {
+		t.Fatalf("memory is %d bytes, want the registers and the members at the promotion", memory)
+	}
+
+	if !h.Contains("series:0") || h.Contains("series:9999") {
+		t.Fatal("wrong membership once promoted")
+	}
+
+	assertEstimate(t, h.Estimate(), 10000)
+}
+
+func TestEstimate(t *testing.T) {
+	for _, count := range []int{1000, 20000, 100000, 1000000} {
+		h := NewEmptyHyperLogLog(0, DefaultPrecision)
+
+		for i := 0; i < count; i++ {
+			h.Insert("series:" + strconv.Itoa(i))
+		}
+
+		assertEstimate(t, h.Estimate(), count)
+	}
+}
+
+func TestInsertIfBelow(t *testing.T) {
+	for _, exactThreshold := range []int{1000, 0} {
+		h := NewEmptyHyperLogLog(exactThreshold, DefaultPrecision)
+		admitted := 0
+
+		for i := 0; i < 2000; i++ {
+			if ok, _ := h.InsertIfBelow(Hash("series:"+strconv.Itoa(i)), 500); ok {
+				admitted++
+			}
+		}
+
+		if exactThreshold > 0 && admitted != 500 {
+			t.Fatalf("admitted %d series, want exactly 500", admitted)
+		}
+
+		assertEstimate(t, h.Estimate(), 500)
+
+		if ok, inserted := h.InsertIfBelow(Hash("series:0"), 500); !ok || inserted {
+			t.Fatalf("known series not admitted at the limit, with exact threshold %d", exactThreshold)
+		}
+	}
+}
+
+func TestInsertIfBelowConcurrently(t *testing.T) {
+	h := NewEmptyHyperLogLog(1000, DefaultPrecision)
+
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				if ok, _ := h.InsertIfBelow(Hash(strconv.Itoa(g)+":"+strconv.Itoa(i)), 100); ok {
+					admitted.Add(1)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if admitted.Load() != 100 {
+		t.Fatalf("admitted %d series, want exactly 100", admitted.Load())
+	}
+}
+
+// TestInsertIfBelowPromoted feeds far more distinct series than the limit through a promoted sketch, as during a
+// cardinality explosion, and checks that only about the limit are admitted.
+func TestInsertIfBelowPromoted(t *testing.T) {
+	for _, limit := range []int{2000, 10000} {
+		h := NewEmptyHyperLogLog(1000, DefaultPrecision)
+		admitted := 0
+
+		for i := 0; i < 1_000_000; i++ {
+			if ok, _ := h.InsertIfBelow(Hash("series:"+strconv.Itoa(i)), uint64(limit)); ok {
+				admitted++
+			}
+		}
+
+		assertEstimate(t, uint64(admitted), limit)
+		assertEstimate(t, h.Estimate(), limit)
+
+		for i := 0; i < admitted; i++ {
+			if ok, inserted := h.InsertIfBelow(Hash("series:"+strconv.Itoa(i)), uint64(limit)); !ok || inserted {
+				t.Fatalf("admitted series %d is not known at the limit %d", i, limit)
+			}
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := NewEmptyHyperLogLog(100, DefaultPrecision)
+	b := NewEmptyHyperLogLog(100, DefaultPrecision-2)
+	c := NewEmptyHyperLogLog(100, DefaultPrecision)
+
+	for i := 0; i < 30000; i++ {
+		a.Insert("series:" + strconv.Itoa(i))
+		b.Insert("series:" + strconv.Itoa(i+20000))
+	}
+
+	c.Insert("series:60000")
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Merge(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Precision() != DefaultPrecision-2 {
+		t.Fatalf("precision is %d, want the lowest one", a.Precision())
+	}
+
+	assertEstimateWithin(t, a.Estimate(), 50001, 4*1.04/math.Sqrt(1<<(DefaultPrecision-2)))
+
+	// The series inserted before the promotion of each one stay known
+
+	if !a.Contains("series:60000") || !a.Contains("series:20000") || !a.Contains("series:0") {
+		t.Fatal("merged series are not contained")
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	for _, count := range []int{10, 5000} {
+		h := NewEmptyHyperLogLog(100, DefaultPrecision)
+
+		for i := 0; i < count; i++ {
+			h.Insert("series:" + strconv.Itoa(i))
+		}
+
+		data, err := h.MarshalBinary()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := NewEmptyHyperLogLog(100, MinPrecision)
+
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.Estimate() != h.Estimate() || decoded.Promoted() != h.Promoted() || decoded.Precision() != DefaultPrecision {
+			t.Fatalf("decoded HyperLogLog of %d series differs", count)
+		}
+	}
+}
+
+func assertEstimate(t *testing.T, estimate uint64, want int) {
+	t.Helper()
+
+	assertEstimateWithin(t, estimate, want, maxRelativeError)
+}
+
+func assertEstimateWithin(t *testing.T, estimate uint64, want int, relativeError float64) {
+	t.Helper()
+
+	if math.Abs(float64(estimate)-float64(want)) > relativeError*float64(want) {
+		t.Fatalf("estimate is %d, want %d within %.1f%%", estimate, want, relativeError*100)
+	}
+}
@@ -0,0 +1,304 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/comfortablynumb/victor/internal/backend"
+	"github.com/comfortablynumb/victor/internal/config"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Constants
+
+const (
+	// peerStaleIntervals is how many intervals the state of a peer is kept after it stops answering.
+	peerStaleIntervals = 3
+	shutdownTimeout    = 5 * time.Second
+)
+
+// Structs
+
+type peerState struct {
+	data     []byte
+	received time.Time
+}
+
+// Gossip shares the cardinality state of the rate limited backends with the peers of a cluster of Victors, and
+// merges theirs, so the limits are enforced against the cardinality of the whole cluster. Every interval, it fetches
+// the state of every peer, from a static list and/or the addresses a DNS name resolves to, over HTTP. A peer can be
+// this same Victor, as merging its own state does not change anything.
+type Gossip struct {
+	listenAddr  string
+	staticPeers []string
+	dnsName     string
+	dnsPort     string
+	interval    time.Duration
+	backends    map[string]*backend.RateLimitedBackend
+	peerStates  map[string]map[string]peerState
+	client      *http.Client
+	server      *http.Server
+	logger      logrus.FieldLogger
+}
+
+func (g *Gossip) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	defer wg.Wait()
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		g.runServer(ctx)
+	}()
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.exchange(ctx)
+		}
+	}
+}
+
+func (g *Gossip) runServer(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := g.server.Shutdown(shutdownCtx); err != nil {
+			g.logger.WithError(err).Error("Failed to shut down the peer server")
+		}
+	}()
+
+	g.logger.WithField("address", g.listenAddr).Info("Peer server started")
+
+	if err := g.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		g.logger.WithError(err).Error("Peer server failed")
+	}
+}
+
+func (g *Gossip) handleState(w http.ResponseWriter, r *http.Request) {
+	b, ok := g.backends[r.PathValue("backend")]
+
+	if !ok {
+		http.Error(w, "backend is not rate limited", http.StatusNotFound)
+
+		return
+	}
+
+	data, err := b.PeerState()
+
+	if err != nil {
+		g.logger.WithError(err).WithField("backend", b.Name()).Error("Failed to encode the peer state")
+
+		http.Error(w, "failed to encode the peer state", http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if _, err := w.Write(data); err != nil {
+		g.logger.WithError(err).Debug("Failed to write the peer state")
+	}
+}
+
+// exchange fetches the state of every peer, and merges the ones that are not stale into the backends.
+func (g *Gossip) exchange(ctx context.Context) {
+	peers := g.peers(ctx)
+	fetched := make([]map[string][]byte, len(peers))
+
+	var wg sync.WaitGroup
+
+	for i, peer := range peers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			fetched[i] = g.fetchPeer(ctx, peer)
+		}()
+	}
+
+	wg.Wait()
+
+	now := time.Now()
+
+	for i, peer := range peers {
+		if g.peerStates[peer] == nil {
+			g.peerStates[peer] = make(map[string]peerState)
+		}
+
+		for backendName, data := range fetched[i] {
+			g.peerStates[peer][backendName] = peerState{data: data, received: now}
+		}
+	}
+
+	staleTime := now.Add(-peerStaleIntervals * g.interval)
+
+	for backendName, b := range g.backends {
+		var states [][]byte
+
+		for peer, stateByBackend := range g.peerStates {
+			state, found := stateByBackend[backendName]
+
+			if !found {
+				continue
+			}
+
+			if state.received.Before(staleTime) {
+				delete(stateByBackend, backendName)
+
+				g.logger.WithField("peer", peer).WithField("backend", backendName).Warn("Forgetting the state of a stale peer")
+
+				continue
+			}
+
+			states = append(states, state.data)
+		}
+
+		if err := b.SetPeerStates(states); err != nil {
+			g.logger.WithError(err).WithField("backend", backendName).Error("Failed to merge the peer states")
+		}
+	}
+}
+
+// peers returns the addresses of the static peers and of the ones the DNS name resolves to.
+func (g *Gossip) peers(ctx context.Context) []string {
+	peers := slices.Clone(g.staticPeers)
+
+	if g.dnsName == "" {
+		return peers
+	}
+
+	hosts, err := net.DefaultResolver.LookupHost(ctx, g.dnsName)
+
+	if err != nil {
+		g.logger.WithError(err).WithField("dns", g.dnsName).Warn("Failed to resolve the peers")
+
+		return peers
+	}
+
+	for _, host := range hosts {
+		peer := net.JoinHostPort(host, g.dnsPort)
+
+		if !slices.Contains(peers, peer) {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+// fetchPeer returns the states of a peer by backend name. Errors are logged, so the previous state of the peer is
+// kept until it gets stale.
+func (g *Gossip) fetchPeer(ctx context.Context, peer string) map[string][]byte {
+	states := make(map[string][]byte, len(g.backends))
+
+	for backendName := range g.backends {
+		data, err := g.fetchState(ctx, peer, backendName)
+
+		if err != nil {
+			g.logger.WithError(err).
+				WithField("peer", peer).
+				WithField("backend", backendName).
+				Warn("Failed to fetch the peer state")
+
+			continue
+		}
+
+		states[backendName] = data
+	}
+
+	return states
+}
+
+func (g *Gossip) fetchState(ctx context.Context, peer string, backendName string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+peer+"/peer/rate-limit/"+backendName, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := g.client.Do(request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+
+	return io.ReadAll(response.Body)
+}
+
+// Static functions
+
+func NewGossip(v *viper.Viper, backends []*backend.RateLimitedBackend, logger logrus.FieldLogger) (*Gossip, error) {
+	v.SetDefault(config.ParamPeerInterval, config.DefaultPeerInterval)
+	v.SetDefault(config.ParamPeerTimeout, config.DefaultPeerTimeout)
+
+	g := &Gossip{
+		listenAddr:  v.GetString(config.ParamPeerListen),
+		staticPeers: v.GetStringSlice(config.ParamPeerStatic),
+		dnsName:     v.GetString(config.ParamPeerDNS),
+		dnsPort:     v.GetString(config.ParamPeerDNSPort),
+		interval:    v.GetDuration(config.ParamPeerInterval),
+		backends:    make(map[string]*backend.RateLimitedBackend, len(backends)),
+		peerStates:  make(map[string]map[string]peerState),
+		client:      &http.Client{Timeout: v.GetDuration(config.ParamPeerTimeout)},
+		logger:      logger,
+	}
+
+	if g.interval <= 0 {
+		return nil, fmt.Errorf("%s must be greater than zero. Value: %s", config.ParamPeerInterval, g.interval)
+	}
+
+	// The peers found through DNS listen on the same port as this Victor, unless configured otherwise
+
+	if g.dnsName != "" && g.dnsPort == "" {
+		_, port, err := net.SplitHostPort(g.listenAddr)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", config.ParamPeerListen, err)
+		}
+
+		g.dnsPort = port
+	}
+
+	for _, b := range backends {
+		g.backends[b.Name()] = b
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /peer/rate-limit/{backend}", g.handleState)
+
+	g.server = &http.Server{
+		Addr:              g.listenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: shutdownTimeout,
+	}
+
+	return g, nil
+}
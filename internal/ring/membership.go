@@ -0,0 +1,169 @@
+package ring
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// Structs
+
+// Membership holds the ring of a static list of members, or of the members listed in a file, one per line. The file
+// is watched, and the ring is rebuilt when its members change.
+type Membership struct {
+	file         string
+	virtualNodes int
+	ring         atomic.Pointer[Ring]
+	logger       logrus.FieldLogger
+}
+
+// Ring returns the current ring.
+func (m *Membership) Ring() *Ring {
+	return m.ring.Load()
+}
+
+// Run watches the members file, if any, and calls onChange with the new ring every time its members change, until
+// the context is done.
+func (m *Membership) Run(ctx context.Context, onChange func(*Ring)) {
+	if m.file == "" {
+		<-ctx.Done()
+
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		m.logger.WithError(err).Error("Failed to watch the members file. The members won't change")
+
+		<-ctx.Done()
+
+		return
+	}
+
+	defer watcher.Close()
+
+	// The directory is watched instead of the file, so the file can be replaced by renaming another one over it,
+	// like Kubernetes does with the files of a ConfigMap.
+	if err := watcher.Add(filepath.Dir(m.file)); err != nil {
+		m.logger.WithError(err).Error("Failed to watch the members file. The members won't change")
+
+		<-ctx.Done()
+
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watcher.Errors:
+			m.logger.WithError(err).Warn("Error watching the members file")
+		case <-watcher.Events:
+			members, err := readMembersFile(m.file)
+
+			if err != nil {
+				m.logger.WithError(err).Warn("Failed to read the members file. Keeping the current members")
+
+				continue
+			}
+
+			current := m.ring.Load()
+
+			if slices.Equal(current.Members(), slices.Compact(slices.Sorted(slices.Values(members)))) {
+				continue
+			}
+
+			ring := New(members, m.virtualNodes)
+
+			m.ring.Store(ring)
+
+			m.logger.WithField("members", ring.Members()).
+				WithField("previous-members", current.Members()).
+				Info("Ring members changed")
+
+			onChange(ring)
+		}
+	}
+}
+
+// Static functions
+
+// NewMembership builds the membership of a static list of members, or of the members listed in a file. Only one of
+// them can be set.
+func NewMembership(members []string, file string, virtualNodes int, logger logrus.FieldLogger) (*Membership, error) {
+	if virtualNodes <= 0 {
+		return nil, fmt.Errorf("invalid virtual nodes. Value: %d", virtualNodes)
+	}
+
+	if len(members) > 0 && file != "" {
+		return nil, errors.New("only one of the members and the members file can be set")
+	}
+
+	if file != "" {
+		var err error
+
+		if members, err = readMembersFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(members) == 0 {
+		return nil, errors.New("the ring has no members")
+	}
+
+	m := &Membership{
+		file:         file,
+		virtualNodes: virtualNodes,
+		logger:       logger,
+	}
+
+	m.ring.Store(New(members, virtualNodes))
+
+	return m, nil
+}
+
+// readMembersFile reads the members of a file, one per line. Empty lines and lines starting with # are skipped. A
+// file without members is an error, so a file being rewritten is never taken as an empty ring.
+func readMembersFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the members file %s: %w", file, err)
+	}
+
+	defer f.Close()
+
+	var members []string
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		members = append(members, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the members file %s: %w", file, err)
+	}
+
+	if len(members) == 0 {
+		return nil, fmt.Errorf("the members file %s has no members", file)
+	}
+
+	return members, nil
+}
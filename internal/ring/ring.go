@@ -0,0 +1,85 @@
+package ring
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+	"strconv"
+
+	metro "github.com/dgryski/go-metro"
+)
+
+// Constants
+
+const (
+	hashSeed = 1337
+	// DefaultVirtualNodes is the default number of points of each member on the ring.
+	DefaultVirtualNodes = 128
+)
+
+// Structs
+
+type point struct {
+	hash   uint64
+	member string
+}
+
+// Ring is a consistent hash ring. Every member owns several points of the ring, so the keys are spread evenly, and
+// only the keys of a member move when it joins or leaves. A Ring is immutable: a membership change builds a new one.
+type Ring struct {
+	members []string
+	points  []point
+}
+
+// Owner returns the member that owns the given key, or an empty string if the ring has no members.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].member
+}
+
+// Members returns the sorted members of the ring.
+func (r *Ring) Members() []string {
+	return slices.Clone(r.members)
+}
+
+// Static functions
+
+// New builds a ring with the given members, each of them with the given number of points.
+func New(members []string, virtualNodes int) *Ring {
+	members = slices.Compact(slices.Sorted(slices.Values(members)))
+	points := make([]point, 0, len(members)*virtualNodes)
+
+	for _, member := range members {
+		for i := range virtualNodes {
+			points = append(points, point{
+				hash:   hashKey(member + "#" + strconv.Itoa(i)),
+				member: member,
+			})
+		}
+	}
+
+	slices.SortFunc(points, func(a, b point) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+
+	return &Ring{
+		members: members,
+		points:  points,
+	}
+}
+
+func hashKey(key string) uint64 {
+	return metro.Hash64Str(key, hashSeed)
+}
@@ -0,0 +1,142 @@
+package spacesaving
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+)
+
+// Structs
+
+// Counter is a key of a Summary with its count. The count overestimates the real count of the key by at most Error.
+type Counter struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// counters is a min-heap of counters by count.
+type counters []*counter
+
+type counter struct {
+	Counter
+
+	index int
+}
+
+func (c counters) Len() int {
+	return len(c)
+}
+
+func (c counters) Less(i, j int) bool {
+	return c[i].Count < c[j].Count
+}
+
+func (c counters) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+	c[i].index = i
+	c[j].index = j
+}
+
+func (c *counters) Push(x any) {
+	item := x.(*counter)
+
+	item.index = len(*c)
+	*c = append(*c, item)
+}
+
+func (c *counters) Pop() any {
+	old := *c
+	item := old[len(old)-1]
+
+	*c = old[:len(old)-1]
+
+	return item
+}
+
+// Summary finds the heaviest keys of a stream with the Space-Saving algorithm: it counts at most capacity keys, and a
+// key that arrives when it's full takes over the counter of the lightest one, inheriting its count as the error. Any
+// key counted more than total/capacity times is guaranteed to be in the summary. It's not safe for concurrent use.
+type Summary struct {
+	capacity int
+	byKey    map[string]*counter
+	heap     counters
+}
+
+// Add adds the given count to a key, and returns the key it took the counter of, if any.
+func (s *Summary) Add(key string, count uint64) (string, bool) {
+	if c, ok := s.byKey[key]; ok {
+		c.Count += count
+
+		heap.Fix(&s.heap, c.index)
+
+		return "", false
+	}
+
+	if len(s.heap) < s.capacity {
+		c := &counter{Counter: Counter{Key: key, Count: count}}
+
+		heap.Push(&s.heap, c)
+
+		s.byKey[key] = c
+
+		return "", false
+	}
+
+	c := s.heap[0]
+	evicted := c.Key
+
+	delete(s.byKey, evicted)
+
+	c.Key = key
+	c.Error = c.Count
+	c.Count += count
+
+	heap.Fix(&s.heap, 0)
+
+	s.byKey[key] = c
+
+	return evicted, true
+}
+
+// Top returns the n heaviest keys, heaviest first.
+func (s *Summary) Top(n int) []Counter {
+	top := make([]Counter, 0, len(s.heap))
+
+	for _, c := range s.heap {
+		top = append(top, c.Counter)
+	}
+
+	slices.SortFunc(top, func(a, b Counter) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Key, b.Key))
+	})
+
+	return top[:min(n, len(top))]
+}
+
+// Decay multiplies every count and error by the given factor, between 0 and 1, so the older counts weigh less than
+// the newer ones. The order of the keys does not change.
+func (s *Summary) Decay(factor float64) {
+	for _, c := range s.heap {
+		c.Count = uint64(float64(c.Count) * factor)
+		c.Error = uint64(float64(c.Error) * factor)
+	}
+}
+
+func (s *Summary) Reset() {
+	s.byKey = make(map[string]*counter, s.capacity)
+	s.heap = make(counters, 0, s.capacity)
+}
+
+// Static functions
+
+// New returns a summary that counts at most capacity keys.
+func New(capacity int) *Summary {
+	s := &Summary{
+		capacity: capacity,
+	}
+
+	s.Reset()
+
+	return s
+}